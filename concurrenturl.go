@@ -11,6 +11,30 @@ When two or more goroutines are running, they need a way to communicate with eac
 
 The xkcd website has a JSON interface to allow external services use their API. Download the data from this interface to build our offline index. https://xkcd.com/info.0.json
 
+The crawler is split over the concurrenturl*.go files, so run it with all of them:
+
+	go run concurrenturl*.go help                 every command, its flags and environment variables
+	go run concurrenturl*.go                      full crawl into xkcd.json
+	go run concurrenturl*.go -from 1 -to 100      only part of the archive
+	go run concurrenturl*.go sync                 only fetch comics missing from xkcd.json
+	go run concurrenturl*.go retry-failed         only fetch comics listed in xkcd.failures.json
+	go run concurrenturl*.go shard -shards dir    split the crawl between processes sharing dir
+	go run concurrenturl*.go show 353             print one comic
+	go run concurrenturl*.go convert a.json a.bin compact binary index with random access
+	go run concurrenturl*.go search "query"       search the offline index
+	go run concurrenturl*.go -images images       also mirror the comic images
+	go run concurrenturl*.go verify               check xkcd.json and the mirrored images
+	go run concurrenturl*.go -jsonl xkcd.jsonl    stream results to disk as they arrive
+	go run concurrenturl*.go -metrics :9100       serve Prometheus metrics while crawling
+	go run concurrenturl*.go -sink stdout         also send results to stdout, a JSON file or a webhook
+	go run concurrenturl*.go serve                serve xkcd.json as a JSON API
+	go run concurrenturl*.go dates -histogram     comics by publication date
+	go run concurrenturl*.go -config local.json   crawl another source or base URL, or -url
+	go run concurrenturl*.go -record fixtures     save HTTP traffic, -replay fixtures plays it back
+	go run concurrenturl*.go bench                measure the HTTP client against a local server
+	go run concurrenturl*.go export csv           export the index as CSV, also atom and html
+	go run concurrenturl*.go diff a.json b.json   what changed between two snapshots of the index
+	go run concurrenturl*.go transcripts -count   lines per character, or -speaker Megan
 
 
 */
@@ -18,12 +42,13 @@ The xkcd website has a JSON interface to allow external services use their API.
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
 )
@@ -44,6 +69,15 @@ type Result struct {
 	Img        string `json:"img"`
 	Title      string `json:"title"`
 	Day        string `json:"day"`
+
+	// Year, Month and Day as a date, read and written as "date" (see concurrenturldates.go)
+	Published time.Time `json:"-"`
+
+	// Transcript parsed into scene notes and dialogue (see concurrenturltranscript.go)
+	Script []ScriptLine `json:"script,omitempty"`
+
+	// local copy of Img, only set when images are mirrored (see concurrenturlimages.go)
+	Image *ImageFile `json:"image,omitempty"`
 }
 
 const Url = "https://xkcd.com"
@@ -51,46 +85,24 @@ const Url = "https://xkcd.com"
 /*
 create a function that serves the core purpose of the application — fetching the comic.
 
-create a custom HTTP client and set timeout to 5 seconds. Join the strings using the strings package, create a new request and send it using the previously created client. If the request is successful, we decode the data from JSON into our local struct. Then we close the response body and return a pointer to the struct.
+The site specific part lives in the Source (see concurrenturlsource.go): it builds the URL (ex: https://xkcd.com/571/info.0.json), sends the request and returns the raw JSON, which it then decodes into our local struct. fetch returns a pointer to that struct.
 
+The request is aborted as soon as ctx is canceled, and an error from the web service comes back as a statusError whose status decides whether it is worth retrying (see concurrenturlretry.go).
 
-*/
-
-func fetch(n int) (*Result, error) {
-
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
 
-	// concatenate strings to get url; ex: https://xkcd.com/571/info.0.json
-
-	url := strings.Join([]string{Url, fmt.Sprintf("%d", n), "info.0.json"}, "/")
-
-	req, err := http.NewRequest("GET", url, nil)
+*/
 
+func fetch(ctx context.Context, n int) (*Result, error) {
+	data, err := source.Fetch(ctx, n)
 	if err != nil {
-		return nil, fmt.Errorf("http request: %v", err)
+		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	result, err := source.Decode(data)
 	if err != nil {
-		return nil, fmt.Errorf("http err: %v", err)
+		return nil, err
 	}
-
-	var data Result
-
-	// error from web service, empty struct to avoid disruption of process
-	if resp.StatusCode != http.StatusOK {
-		data = Result{}
-	} else {
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			return nil, fmt.Errorf("json err: %v", err)
-		}
-	}
-
-	resp.Body.Close()
-
-	return &data, nil
+	return &result, nil
 }
 
 type Job struct {
@@ -108,11 +120,15 @@ var jobs = make(chan Job, 100)
 var results = make(chan Result, 100)
 var resultCollection []Result
 
-func allocateJobs(noOfJobs int) {
-	for i := 0; i <= noOfJobs; i++ {
-		jobs <- Job{i + 1}
+func allocateJobs(ctx context.Context, numbers []int) {
+	defer close(jobs)
+	for _, n := range numbers {
+		select {
+		case jobs <- Job{n}:
+		case <-ctx.Done():
+			return
+		}
 	}
-	close(jobs)
 }
 
 /*
@@ -128,22 +144,38 @@ First define a worker function. The worker gets a job from the allocated jobs ch
 
 */
 
-func worker(wg *sync.WaitGroup) {
+func worker(ctx context.Context, wg *sync.WaitGroup) {
 	for job := range jobs {
-		result, err := fetch(job.number)
+		// after cancellation the remaining jobs are drained without being fetched
+		if ctx.Err() != nil {
+			continue
+		}
+		result, err := fetchWithRetry(ctx, job.number, defaultRetry)
+		if ctx.Err() != nil {
+			continue
+		}
 		if err != nil {
+			metrics.failed.Add(1)
 			log.Printf("error in fetching: %v\n", err)
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				failures.add(fe)
+			}
+			continue
 		}
+		metrics.fetched.Add(1)
+		failures.succeeded(job.number)
+		mirrorImage(ctx, result)
 		results <- *result
 	}
 	wg.Done()
 }
 
-func createWorkerPool(noOfWorkers int) {
+func createWorkerPool(ctx context.Context, noOfWorkers int) {
 	var wg sync.WaitGroup
-	for i := 0; i <= noOfWorkers; i++ {
+	for i := 0; i < noOfWorkers; i++ {
 		wg.Add(1)
-		go worker(&wg)
+		go worker(ctx, &wg)
 	}
 	wg.Wait()
 	close(results)
@@ -158,60 +190,288 @@ If the result from the results channel is valid, append it to the results collec
 */
 
 func getResults(done chan bool) {
+	// resultCollection or the -jsonl log, and the -sink sinks (see concurrenturlsink.go)
+	out := resultSinks()
 	for result := range results {
 		if result.Num != 0 {
-			fmt.Printf("Retrieving issue #%d\n", result.Num)
-			resultCollection = append(resultCollection, result)
+			// the progress line replaces these on a terminal (see concurrenturlmetrics.go)
+			if !showProgress {
+				fmt.Fprintf(console, "Retrieving issue #%d\n", result.Num)
+			}
+
+			if err := out.Write(result); err != nil {
+				log.Printf("error in writing #%d: %v\n", result.Num, err)
+			}
 		}
 	}
 	done <- true
 }
 
 /*
-First, allocate jobs. Use 3000 because at the time of writing, xkcd has over 2500 comic issues, and we want to make sure we get all of them.
-
-
+runPool fetches numbers with the worker pool and waits until every result is collected. All noOfWorkers workers are started, but only as many requests as the adaptive limit allows are in flight at a time (see concurrenturladaptive.go).
 */
 
-func main() {
-	// allocate jobs
-	noOfJobs := 3000
-	go allocateJobs(noOfJobs)
+func runPool(ctx context.Context, numbers []int, noOfWorkers int) {
+	// both channels are closed at the end of a run, a sharded crawl runs the pool once per chunk
+	jobs = make(chan Job, 100)
+	results = make(chan Result, 100)
+	metrics.begin(len(numbers), jobs, results)
+
+	go allocateJobs(ctx, numbers)
 
-	// get results
 	done := make(chan bool)
 	go getResults(done)
 
-	// create worker pool
-	noOfWorkers := 100
-	createWorkerPool(noOfWorkers)
+	adjustCtx, stopAdjusting := context.WithCancel(ctx)
+	go concurrency.run(adjustCtx)
 
-	// wait for all results to be collected
-	<-done
+	stopProgress := func() {}
+	if showProgress {
+		stopProgress = startProgress()
+	}
 
-	// convert result collection to JSON
-	data, err := json.MarshalIndent(resultCollection, "", "    ")
-	if err != nil {
-		log.Fatal("json err: ", err)
+	if len(numbers) < noOfWorkers {
+		noOfWorkers = len(numbers)
 	}
+	createWorkerPool(ctx, noOfWorkers)
+	stopAdjusting()
 
-	// write json data to file
-	err = writeToFile(data)
-	if err != nil {
-		log.Fatal(err)
+	<-done
+	stopProgress()
+	failures.report()
+	if err := failures.save(failuresFile()); err != nil {
+		log.Printf("error in writing %s: %v\n", failuresFile(), err)
+	}
+	fmt.Fprintln(console, concurrency.summary())
+	fmt.Fprintln(console, polite.summary())
+	if httpCache != nil {
+		fmt.Fprintln(console, httpCache.summary())
 	}
 }
 
-func writeToFile(data []byte) error {
-	f, err := os.Create("xkcd.json")
-	if err != nil {
+/*
+First, allocate jobs. Instead of guessing how many comics there are, ask xkcd for the latest one and allocate exactly the issues in range (see concurrenturlxkcd.go). -from and -to restrict the crawl to part of the archive.
+
+The whole run shares one context: Ctrl-C, SIGTERM or the -timeout deadline cancel it, and what was collected so far is saved as a checkpoint (see concurrenturlcontext.go).
+
+
+*/
+
+func main() {
+	// the commands and their exit codes are in concurrenturlcli.go
+	os.Exit(run(os.Args[1:]))
+}
+
+// crawlCommand runs crawl, sync and retry-failed, which share their flags.
+func crawlCommand(mode string, args []string) error {
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	addIndexFlag(fs)
+	workers := fs.Int("workers", 0, "fixed number of concurrent requests, overrides -min-workers and -max-workers")
+	minWorkers := fs.Int("min-workers", 4, "concurrent requests to start with, the pool never shrinks below this")
+	maxWorkers := fs.Int("max-workers", 100, "upper bound for concurrent requests")
+	from := fs.Int("from", 1, "first comic number to fetch")
+	to := fs.Int("to", 0, "last comic number to fetch (0 means the latest comic)")
+	timeout := fs.Duration("timeout", 0, "give up and checkpoint after this long (0 means no deadline)")
+	imagesDir := fs.String("images", "", "also download images into this content-addressed store")
+	jsonlPath := fs.String("jsonl", "", "append results to this JSON Lines log as they arrive")
+	rate := fs.Float64("rate", 10, "requests per second (0 means unlimited)")
+	burst := fs.Int("burst", 10, "requests allowed in a burst above -rate")
+	perHost := fs.Int("per-host", 10, "concurrent requests per host")
+	userAgent := fs.String("user-agent", defaultUserAgent, "User-Agent header sent with every request")
+	robots := fs.Bool("robots", true, "honor the site's robots.txt")
+	baseURL := fs.String("url", "", "base URL of the source, overrides the config file (default "+Url+")")
+	configPath := fs.String("config", "", "JSON config file choosing the source and its base URL")
+	recordDir := fs.String("record", "", "save every HTTP response as a fixture in this directory")
+	replayDir := fs.String("replay", "", "serve HTTP responses from the fixtures in this directory instead of the network")
+	cacheDir := fs.String("cache", "xkcd.cache", "HTTP cache directory for conditional requests (empty to disable)")
+	refresh := fs.Bool("refresh", false, "ignore the HTTP cache and download everything again")
+	retryMissing := fs.Bool("missing", false, "retry-failed: also retry comics that were missing (404)")
+	shardDir := fs.String("shards", "", "shard: directory shared by every process of the crawl")
+	chunk := fs.Int("chunk", 100, "shard: comic numbers per chunk")
+	leaseTTL := fs.Duration("lease", time.Minute, "shard: a chunk is taken over when its lease was not renewed for this long")
+	mergeOnly := fs.Bool("merge", false, "shard: only merge the logs in -shards into the index")
+	progress := fs.Bool("progress", isTerminal(os.Stderr), "redraw one progress line instead of printing every comic")
+	var sinkSpecs []string
+	fs.Func("sink", "also send results to stdout, json:path, jsonl:path or webhook:url (repeatable)", func(v string) error {
+		sinkSpecs = append(sinkSpecs, v)
+		return nil
+	})
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics on this address while crawling, e.g. localhost:9100")
+	clientCfg := defaultClientConfig
+	clientCfg.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	}
-	defer f.Close()
+	if fs.NArg() > 0 {
+		return usagef("%s takes no arguments, got %q", mode, fs.Args())
+	}
+	if mode == "shard" && (*shardDir == "" || *chunk < 1 || *jsonlPath != "") {
+		return usagef("shard needs -shards and a positive -chunk, and writes its own logs instead of -jsonl")
+	}
+	if mode == "shard" && *mergeOnly {
+		return mergeShards(*shardDir)
+	}
+
+	// the pool grows and shrinks between the bounds (see concurrenturladaptive.go)
+	if *workers > 0 {
+		*minWorkers, *maxWorkers = *workers, *workers
+	}
+	concurrency = newAdaptiveLimit(*minWorkers, *maxWorkers)
+	noOfWorkers := concurrency.max
+	clientCfg.Workers = noOfWorkers
+
+	// one tuned client for the whole run (see concurrenturlclient.go)
+	transport = newBaseTransport(clientCfg)
+
+	// see concurrenturlrecord.go
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		return usagef("-record and -replay cannot be combined")
+	case *recordDir != "":
+		rt, err := newRecordingTransport(transport, *recordDir)
+		if err != nil {
+			return err
+		}
+		transport = rt
+	case *replayDir != "":
+		transport = &replayTransport{dir: *replayDir}
+		*rate = 0
+	}
+
+	// measured below the cache, so revalidations count as the 304s they are (see concurrenturlmetrics.go)
+	transport = &metricsTransport{next: transport}
 
-	_, err = f.Write(data)
+	// fixtures must hold complete responses, so recording and replaying go without the cache (see concurrenturlcache.go)
+	if *recordDir != "" || *replayDir != "" {
+		*cacheDir = ""
+	}
+	if *cacheDir != "" {
+		var err error
+		if httpCache, err = newCachingTransport(transport, *cacheDir, *refresh); err != nil {
+			return err
+		}
+		transport = httpCache
+	}
+	httpClient = &http.Client{Transport: transport, Timeout: clientCfg.RequestTimeout}
+
+	cfg := &Config{Source: "xkcd"}
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	if *baseURL != "" {
+		cfg.BaseURL = *baseURL
+	}
+	var err error
+	if source, err = cfg.newSource(); err != nil {
+		return err
+	}
+
+	polite = newPoliteness(*rate, *burst, *perHost, *userAgent, *robots)
+
+	if *imagesDir != "" {
+		index, err := loadIndex(indexFile)
+		if err != nil {
+			return err
+		}
+		if mirror, err = newImageStore(*imagesDir, index); err != nil {
+			return err
+		}
+	}
+
+	if *jsonlPath != "" {
+		if stream, err = openJSONL(*jsonlPath); err != nil {
+			return err
+		}
+	}
+
+	showProgress = *progress
+	if *metricsAddr != "" {
+		stopMetrics, err := serveMetrics(*metricsAddr)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	ctx, stop := crawlContext(*timeout)
+	defer stop()
+
+	// the webhook gives up on its retries when the crawl is interrupted (see concurrenturlsink.go)
+	if sinks, err = openSinks(ctx, sinkSpecs); err != nil {
+		return err
+	}
+	defer func() {
+		if err := sinks.Close(); err != nil {
+			log.Println(err)
+		}
+		sinks = nil
+	}()
+
+	switch mode {
+	case "crawl":
+	case "sync":
+		// only fetch what is missing from an existing xkcd.json (see concurrenturlsync.go)
+		if err := syncIndex(ctx, *from, *to, noOfWorkers, *jsonlPath); err != nil {
+			return err
+		}
+		return incomplete(ctx)
+	case "retry-failed":
+		// only fetch what failed before (see concurrenturlmanifest.go)
+		if err := retryFailed(ctx, *retryMissing, noOfWorkers, *jsonlPath); err != nil {
+			return err
+		}
+		return incomplete(ctx)
+	case "shard":
+		// split the range with other processes (see concurrenturlshard.go)
+		plan := shardPlan{From: max(*from, 1), To: *to, Chunk: *chunk}
+		if err := shardCrawl(ctx, *shardDir, plan, *leaseTTL, noOfWorkers); err != nil {
+			return err
+		}
+		return incomplete(ctx)
+	default:
+		return usagef("unknown mode %q", mode)
+	}
+
+	// allocate jobs
+	numbers, err := source.IDs(ctx, *from, *to)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// get results with the worker pool
+	runPool(ctx, numbers, noOfWorkers)
+
+	// the log already holds every result, interrupted or not
+	if stream != nil {
+		if _, err := finishStream(*jsonlPath); err != nil {
+			return err
+		}
+		return incomplete(ctx)
+	}
+
+	// an interrupted crawl must not replace a complete index with a partial one
+	if ctx.Err() != nil {
+		if err := writeCheckpoint(resultCollection); err != nil {
+			return err
+		}
+		return incomplete(ctx)
+	}
+
+	// merge the result collection into the index, so a crawl of part of the range or one where fetches failed
+	// keeps the other comics; written as JSON, or as the binary index if -index ends in .bin
+	if _, err := updateIndex(resultCollection); err != nil {
+		return err
+	}
+	return incomplete(ctx)
+}
+
+/*
+The data is written to a temporary file first and then renamed over xkcd.json. The rename is atomic, so an interrupted write never leaves a truncated index behind.
+*/
+
+func writeToFile(data []byte) error {
+	return writeFileAtomic(indexFile, data)
 }
@@ -0,0 +1,163 @@
+/*
+Adaptive concurrency for the worker pool.
+
+A fixed number of workers is either too timid for a fast server or too aggressive for a struggling one. The pool now starts every worker up to -max-workers, but a request may only be sent while fewer than "limit" requests are in flight. The limit starts at -min-workers and is adjusted once per second by an AIMD controller, the same idea TCP uses for its congestion window:
+
+	additive increase          when the window was healthy and the limit was actually reached, allow one more request
+	multiplicative decrease    when more than 5% of the requests were throttled or failed (429, 5xx, timeouts), halve the limit;
+	                           when the average latency is more than twice the baseline, cut it by a quarter
+
+The baseline is the lowest average latency seen so far, slowly drifting up so a server that is simply slower than at the start does not keep the limit down forever. Every change is logged with its reason, so a change in throughput in the middle of a crawl can be explained afterwards.
+
+	go run concurrenturl*.go -min-workers 4 -max-workers 100
+	go run concurrenturl*.go -min-workers 50 -max-workers 50     fixed size, no adaptation
+
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	adjustInterval   = time.Second
+	minWindow        = 5    // requests needed before the controller acts on a window
+	errorThreshold   = 0.05 // share of throttled or failed requests that halves the limit
+	latencyThreshold = 2.0  // latency compared to the baseline that shrinks the limit
+)
+
+type adaptiveLimit struct {
+	min, max int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inflight int
+
+	// the current window
+	requests    int
+	congested   int
+	latencySum  time.Duration
+	maxInflight int
+
+	baseline time.Duration
+}
+
+// concurrency bounds the requests in flight, main sets it from the flags
+var concurrency = newAdaptiveLimit(100, 100)
+
+func newAdaptiveLimit(lo, hi int) *adaptiveLimit {
+	lo = max(lo, 1)
+	hi = max(hi, lo)
+	l := &adaptiveLimit{min: lo, max: hi, limit: lo}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits for a free slot under the current limit.
+func (l *adaptiveLimit) acquire(ctx context.Context) error {
+	// wake the waiters when ctx is canceled, sync.Cond cannot select on a channel
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inflight >= l.limit {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.cond.Wait()
+	}
+	l.inflight++
+	l.maxInflight = max(l.maxInflight, l.inflight)
+	return nil
+}
+
+// release frees the slot and records how the request went.
+func (l *adaptiveLimit) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	l.requests++
+	l.latencySum += latency
+	if err != nil && classify(err) == classTransient {
+		l.congested++
+	}
+	l.cond.Signal()
+}
+
+// adjust applies one AIMD step to the window that just ended and starts a new one.
+func (l *adaptiveLimit) adjust() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.requests < minWindow {
+		return
+	}
+
+	avg := l.latencySum / time.Duration(l.requests)
+	errRate := float64(l.congested) / float64(l.requests)
+	switch {
+	case l.baseline == 0 || avg < l.baseline:
+		l.baseline = avg
+	default:
+		l.baseline += (avg - l.baseline) / 20
+	}
+
+	old, reason := l.limit, ""
+	switch {
+	case errRate > errorThreshold:
+		l.limit = max(l.min, l.limit/2)
+		reason = fmt.Sprintf("%d of %d requests throttled or failed (%.0f%%)", l.congested, l.requests, errRate*100)
+	case float64(avg) > latencyThreshold*float64(l.baseline):
+		l.limit = max(l.min, l.limit*3/4)
+		reason = fmt.Sprintf("latency %v is %.1fx the baseline %v", avg.Round(time.Microsecond), float64(avg)/float64(l.baseline), l.baseline.Round(time.Microsecond))
+	case l.maxInflight >= l.limit:
+		l.limit = min(l.max, l.limit+1)
+		reason = fmt.Sprintf("healthy: latency %v, %d requests without errors", avg.Round(time.Microsecond), l.requests)
+	}
+
+	if l.limit != old {
+		log.Printf("workers %d -> %d: %s\n", old, l.limit, reason)
+		l.cond.Broadcast()
+	}
+
+	l.requests, l.congested, l.latencySum, l.maxInflight = 0, 0, 0, l.inflight
+}
+
+// run adjusts the limit every adjustInterval until ctx is done.
+func (l *adaptiveLimit) run(ctx context.Context) {
+	if l.min == l.max {
+		return
+	}
+
+	ticker := time.NewTicker(adjustInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.adjust()
+		}
+	}
+}
+
+func (l *adaptiveLimit) summary() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.min == l.max {
+		return fmt.Sprintf("workers: fixed at %d", l.limit)
+	}
+	return fmt.Sprintf("workers: %d at the end (bounds %d..%d)", l.limit, l.min, l.max)
+}
@@ -0,0 +1,332 @@
+/*
+A compact binary index with random access.
+
+Looking up one comic in xkcd.json means reading and decoding the whole pretty-printed file. The binary index keeps every comic as its own gzip member, so a reader only decompresses the comics it asks for:
+
+	magic      "XKCDBIN1"
+	records    one gzip member per comic holding its JSON, in the order of the JSON index
+	numbers    count (uint32), then per comic its number (uint32), offset (uint64) and length (uint32), sorted by number
+	years      count (uint32), then per comic its year (uint32) and number (uint32), sorted by year and number
+	trailer    offset of the numbers section (uint64), then the magic again
+
+All integers are little endian. Opening the file reads only the two small index sections at its end; Get, Range and Year then decode just the records they return, and Iterate walks the records in their stored order. As the records are the JSON encoding of Result, in their original order and including duplicates, converting JSON to binary and back gives the same xkcd.json.
+
+	go run concurrenturl*.go convert xkcd.json xkcd.bin
+	go run concurrenturl*.go convert xkcd.bin xkcd.json
+	go run concurrenturl*.go show -index xkcd.bin 353
+	go run concurrenturl*.go dates -index xkcd.bin -year 2010
+
+Every command reads and writes the binary form when -index ends in .bin; show and dates -year use the reader directly and decode only the comics they print.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	binaryMagic = "XKCDBIN1"
+	binaryExt   = ".bin"
+)
+
+var errComicNotFound = errors.New("comic not found")
+
+type binaryEntry struct {
+	Num    uint32
+	Offset uint64
+	Length uint32
+}
+
+type binaryYear struct {
+	Year uint32
+	Num  uint32
+}
+
+type binaryIndex struct {
+	f        *os.File
+	byNum    []binaryEntry
+	byOffset []binaryEntry
+	years    []binaryYear
+}
+
+func isBinaryIndex(path string) bool {
+	return strings.HasSuffix(path, binaryExt)
+}
+
+func writeBinaryIndex(path string, index []Result) error {
+	var buf bytes.Buffer
+	buf.WriteString(binaryMagic)
+
+	entries := make([]binaryEntry, 0, len(index))
+	var years []binaryYear
+	zw := gzip.NewWriter(&buf)
+	for _, r := range index {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("json err: #%d: %v", r.Num, err)
+		}
+
+		offset := buf.Len()
+		zw.Reset(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		entries = append(entries, binaryEntry{uint32(r.Num), uint64(offset), uint32(buf.Len() - offset)})
+
+		if y, err := strconv.Atoi(r.Year); err == nil {
+			years = append(years, binaryYear{uint32(y), uint32(r.Num)})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Num < entries[j].Num })
+	sort.Slice(years, func(i, j int) bool {
+		if years[i].Year != years[j].Year {
+			return years[i].Year < years[j].Year
+		}
+		return years[i].Num < years[j].Num
+	})
+
+	indexOffset := uint64(buf.Len())
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	binary.Write(&buf, binary.LittleEndian, entries)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(years)))
+	binary.Write(&buf, binary.LittleEndian, years)
+	binary.Write(&buf, binary.LittleEndian, indexOffset)
+	buf.WriteString(binaryMagic)
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+func openBinaryIndex(path string) (*binaryIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &binaryIndex{f: f}
+	if err := b.readIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// readIndex loads the numbers and years sections from the end of the file.
+func (b *binaryIndex) readIndex() error {
+	st, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	trailerLen := int64(8 + len(binaryMagic))
+	if size < int64(len(binaryMagic))+trailerLen {
+		return errors.New("not a binary index: too short")
+	}
+
+	head := make([]byte, len(binaryMagic))
+	trailer := make([]byte, trailerLen)
+	if _, err := b.f.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if _, err := b.f.ReadAt(trailer, size-trailerLen); err != nil {
+		return err
+	}
+	if string(head) != binaryMagic || string(trailer[8:]) != binaryMagic {
+		return errors.New("not a binary index: bad magic")
+	}
+
+	indexOffset := int64(binary.LittleEndian.Uint64(trailer))
+	if indexOffset < int64(len(binaryMagic)) || indexOffset > size-trailerLen {
+		return errors.New("corrupt binary index: bad index offset")
+	}
+	r := io.NewSectionReader(b.f, indexOffset, size-trailerLen-indexOffset)
+
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return fmt.Errorf("corrupt binary index: %v", err)
+	}
+	if int64(n)*16 > r.Size() {
+		return errors.New("corrupt binary index: bad number of comics")
+	}
+	b.byNum = make([]binaryEntry, n)
+	if err := binary.Read(r, binary.LittleEndian, b.byNum); err != nil {
+		return fmt.Errorf("corrupt binary index: %v", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return fmt.Errorf("corrupt binary index: %v", err)
+	}
+	if int64(n)*8 > r.Size() {
+		return errors.New("corrupt binary index: bad number of years")
+	}
+	b.years = make([]binaryYear, n)
+	if err := binary.Read(r, binary.LittleEndian, b.years); err != nil {
+		return fmt.Errorf("corrupt binary index: %v", err)
+	}
+
+	b.byOffset = append([]binaryEntry(nil), b.byNum...)
+	sort.Slice(b.byOffset, func(i, j int) bool { return b.byOffset[i].Offset < b.byOffset[j].Offset })
+	return nil
+}
+
+func (b *binaryIndex) Close() error {
+	return b.f.Close()
+}
+
+func (b *binaryIndex) Len() int {
+	return len(b.byNum)
+}
+
+// Latest is the highest comic number in the index, 0 when it is empty.
+func (b *binaryIndex) Latest() int {
+	if len(b.byNum) == 0 {
+		return 0
+	}
+	return int(b.byNum[len(b.byNum)-1].Num)
+}
+
+// read decodes the record of one entry.
+func (b *binaryIndex) read(e binaryEntry) (Result, error) {
+	zr, err := gzip.NewReader(io.NewSectionReader(b.f, int64(e.Offset), int64(e.Length)))
+	if err != nil {
+		return Result{}, fmt.Errorf("corrupt record #%d: %v", e.Num, err)
+	}
+	defer zr.Close()
+
+	var r Result
+	if err := json.NewDecoder(zr).Decode(&r); err != nil {
+		return Result{}, fmt.Errorf("corrupt record #%d: %v", e.Num, err)
+	}
+	return r, nil
+}
+
+// Get decodes the comic num, errComicNotFound when the index does not have it.
+func (b *binaryIndex) Get(num int) (Result, error) {
+	i := sort.Search(len(b.byNum), func(i int) bool { return int(b.byNum[i].Num) >= num })
+	if i == len(b.byNum) || int(b.byNum[i].Num) != num {
+		return Result{}, fmt.Errorf("#%d: %w", num, errComicNotFound)
+	}
+	return b.read(b.byNum[i])
+}
+
+// Range decodes the comics from..to, both included, in order of their number.
+func (b *binaryIndex) Range(from, to int) ([]Result, error) {
+	i := sort.Search(len(b.byNum), func(i int) bool { return int(b.byNum[i].Num) >= from })
+	var list []Result
+	for ; i < len(b.byNum) && int(b.byNum[i].Num) <= to; i++ {
+		r, err := b.read(b.byNum[i])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// Year decodes the comics published in year, using the years section.
+func (b *binaryIndex) Year(year int) ([]Result, error) {
+	i := sort.Search(len(b.years), func(i int) bool { return int(b.years[i].Year) >= year })
+	var list []Result
+	for ; i < len(b.years) && int(b.years[i].Year) == year; i++ {
+		r, err := b.Get(int(b.years[i].Num))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// Iterate calls fn for every comic in the stored order and stops at the first error.
+func (b *binaryIndex) Iterate(fn func(Result) error) error {
+	for _, e := range b.byOffset {
+		r, err := b.read(e)
+		if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinaryIndex(path string) ([]Result, error) {
+	b, err := openBinaryIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	index := make([]Result, 0, b.Len())
+	err = b.Iterate(func(r Result) error {
+		index = append(index, r)
+		return nil
+	})
+	return index, err
+}
+
+func readBinaryYear(path string, year int) ([]Result, error) {
+	b, err := openBinaryIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return b.Year(year)
+}
+
+func convertCommand(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usagef("need the file to convert and the file to write")
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+	if isBinaryIndex(in) == isBinaryIndex(out) {
+		return usagef("one of the files must be JSON and the other %s", binaryExt)
+	}
+
+	var index []Result
+	var err error
+	if isBinaryIndex(in) {
+		index, err = readBinaryIndex(in)
+	} else {
+		index, err = loadSnapshot(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	if isBinaryIndex(out) {
+		err = writeBinaryIndex(out, index)
+	} else {
+		var data []byte
+		if data, err = json.MarshalIndent(index, "", "    "); err == nil {
+			err = writeFileAtomic(out, data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if st, err := os.Stat(out); err == nil {
+		log.Printf("converted %d comics from %s to %s (%d bytes)\n", len(index), in, out, st.Size())
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+A local HTTP cache with conditional requests.
+
+Old comics never change, yet every run downloads their JSON again. With the cache, every response that carries a validator (an ETag or a Last-Modified header) is saved on disk, keyed by URL. The next run sends the saved validators as If-None-Match and If-Modified-Since, and when the server answers 304 Not Modified the saved body is used instead: a few hundred bytes of headers instead of the whole document.
+
+	go run concurrenturl*.go sync                   uses the cache in xkcd.cache
+	go run concurrenturl*.go -cache ""              no cache
+	go run concurrenturl*.go -refresh               skip the conditional requests and download everything again
+
+The cache is off when recording or replaying (see concurrenturlrecord.go): it would turn the recorded responses into bodyless 304s, which a replay without the same cache cannot use. Images are not cached here, the image store already keeps them (see concurrenturlimages.go). Hits, misses and the bytes saved by 304 responses are printed with the run summary.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type cachingTransport struct {
+	next    http.RoundTripper
+	dir     string
+	refresh bool
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	saved  atomic.Int64
+}
+
+// httpCache is nil when the cache is switched off
+var httpCache *cachingTransport
+
+func newCachingTransport(next http.RoundTripper, dir string, refresh bool) (*cachingTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cachingTransport{next: next, dir: dir, refresh: refresh}, nil
+}
+
+func (t *cachingTransport) load(req *http.Request) *fixture {
+	data, err := os.ReadFile(fixturePath(t.dir, req))
+	if err != nil {
+		return nil
+	}
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil
+	}
+	return &f
+}
+
+func (t *cachingTransport) store(req *http.Request, resp *http.Response, body []byte) error {
+	data, err := json.Marshal(newFixture(req, resp, body))
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	return writeFileAtomic(fixturePath(t.dir, req), data)
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return t.next.RoundTrip(req)
+	}
+
+	var cached *fixture
+	if !t.refresh {
+		cached = t.load(req)
+	}
+	if cached != nil {
+		// RoundTrip must not modify the caller's request
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := cached.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		body := cached.body()
+		t.hits.Add(1)
+		t.saved.Add(int64(len(body)))
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.Header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	t.misses.Add(1)
+	if resp.StatusCode != http.StatusOK ||
+		(resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := t.store(req, resp, body); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	return resp, nil
+}
+
+func (t *cachingTransport) summary() string {
+	return fmt.Sprintf("cache: %d hits, %d misses, %d bytes saved by 304 responses", t.hits.Load(), t.misses.Load(), t.saved.Load())
+}
@@ -0,0 +1,228 @@
+/*
+The command line.
+
+Every command is an entry in commands with a one-line summary for the help text, and parses its own flags. Without a command the tool crawls, so the old invocations keep working:
+
+	go run concurrenturl*.go help                 every command
+	go run concurrenturl*.go help crawl           the flags of one command, same as crawl -h
+	go run concurrenturl*.go -from 2500           crawl
+
+Scheduled jobs usually configure the tool through the environment. These variables set the flag of the same name in every command that has it; a flag given on the command line wins:
+
+	XKCD_INDEX              -index             the JSON index every command reads or writes (xkcd.json)
+	XKCD_URL                -url               base URL of the source
+	XKCD_CONFIG             -config            JSON config file choosing the source
+	XKCD_WORKERS            -workers           fixed number of concurrent requests
+	XKCD_MIN_WORKERS        -min-workers
+	XKCD_MAX_WORKERS        -max-workers
+	XKCD_FROM, XKCD_TO      -from, -to         the range of comics
+	XKCD_TIMEOUT            -timeout           deadline for the whole run
+	XKCD_REQUEST_TIMEOUT    -request-timeout   and -dial-timeout, -tls-timeout, -header-timeout likewise
+	XKCD_RATE               -rate
+	XKCD_USER_AGENT         -user-agent
+	XKCD_CACHE              -cache
+	XKCD_METRICS            -metrics           address to serve Prometheus metrics on while crawling
+
+The exit code tells a scheduler what happened:
+
+	0    success
+	1    the command failed
+	2    usage error: unknown command, bad flag, bad environment variable or missing argument
+	3    incomplete: the crawl was interrupted or some comics could not be fetched (see xkcd.failures.json)
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitIncomplete = 3
+)
+
+// usageError is returned by a command that was called with missing or wrong arguments.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// errIncomplete marks a run that saved its results but did not get every comic.
+var errIncomplete = errors.New("incomplete")
+
+// incomplete reports whether the run that just ended got every comic, after its results were saved.
+func incomplete(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: interrupted: %v", errIncomplete, context.Cause(ctx))
+	}
+	if n := len(failures.list()); n > 0 {
+		return fmt.Errorf("%w: %d comics could not be fetched, see %s", errIncomplete, n, failuresFile())
+	}
+	return nil
+}
+
+type command struct {
+	name    string
+	args    string // what follows the flags, for the usage line
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+// commands is filled in init because the commands themselves look it up for their usage text.
+func init() {
+	commands = []command{
+		{"crawl", "", "fetch every comic in the range into the index (the default)", func(args []string) error { return crawlCommand("crawl", args) }},
+		{"sync", "", "only fetch comics missing from the index", func(args []string) error { return crawlCommand("sync", args) }},
+		{"retry-failed", "", "only fetch comics listed in the failure manifest next to the index", func(args []string) error { return crawlCommand("retry-failed", args) }},
+		{"shard", "", "crawl together with other processes sharing a directory", func(args []string) error { return crawlCommand("shard", args) }},
+		{"show", "number|latest|random", "print one comic", showCommand},
+		{"search", `"query"`, "full-text search", searchCommand},
+		{"export", "format...", "export the index as csv, atom or html", exportCommand},
+		{"verify", "", "check the index and the mirrored images", verifyCommand},
+		{"serve", "", "serve the index as a JSON API", serveCommand},
+		{"dates", "", "comics by publication date", datesCommand},
+		{"transcripts", "", "query the parsed transcripts", transcriptsCommand},
+		{"diff", "old.json new.json", "what changed between two snapshots of the index", diffCommand},
+		{"convert", "in out", "convert the index between JSON and the binary format (.bin)", convertCommand},
+		{"compact", "", "merge a JSON Lines log into the index", compactCommand},
+		{"bench", "", "measure the HTTP client against a local server", benchCommand},
+	}
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s [command] [flags] [arguments]\n\ncommands:\n", progName())
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s help command' for the flags of a command.\n", progName())
+	fmt.Fprintf(w, "Exit codes: %d success, %d failure, %d usage error, %d incomplete crawl.\n", exitOK, exitError, exitUsage, exitIncomplete)
+}
+
+// envFlags are the flags that can also be set from the environment
+var envFlags = map[string]string{
+	"index":           "XKCD_INDEX",
+	"url":             "XKCD_URL",
+	"config":          "XKCD_CONFIG",
+	"workers":         "XKCD_WORKERS",
+	"min-workers":     "XKCD_MIN_WORKERS",
+	"max-workers":     "XKCD_MAX_WORKERS",
+	"from":            "XKCD_FROM",
+	"to":              "XKCD_TO",
+	"timeout":         "XKCD_TIMEOUT",
+	"request-timeout": "XKCD_REQUEST_TIMEOUT",
+	"dial-timeout":    "XKCD_DIAL_TIMEOUT",
+	"tls-timeout":     "XKCD_TLS_TIMEOUT",
+	"header-timeout":  "XKCD_HEADER_TIMEOUT",
+	"rate":            "XKCD_RATE",
+	"user-agent":      "XKCD_USER_AGENT",
+	"cache":           "XKCD_CACHE",
+	"metrics":         "XKCD_METRICS",
+}
+
+// parseFlags sets the flags from the environment first and then from args, and gives fs the usage text of its command.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		c, _ := lookupCommand(fs.Name())
+		out := fs.Output()
+		line := strings.TrimSpace(fmt.Sprintf("%s %s [flags] %s", progName(), fs.Name(), c.args))
+		fmt.Fprintf(out, "usage: %s\n\n%s\n\nflags:\n", line, c.summary)
+		fs.PrintDefaults()
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env, ok := envFlags[f.Name]
+		if !ok {
+			return
+		}
+		f.Usage += " [$" + env + "]"
+		if v, set := os.LookupEnv(env); set && err == nil {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = usagef("$%s: %v", env, e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fs.Parse(args)
+}
+
+func addIndexFlag(fs *flag.FlagSet) {
+	fs.StringVar(&indexFile, "index", indexFile, "the JSON index")
+}
+
+// run executes the command in args and returns the exit code.
+func run(args []string) int {
+	// an optional command comes first, its flags after it: sync -from 2500
+	name := "crawl"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	} else if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	if name == "help" {
+		if len(args) == 0 {
+			printUsage(os.Stdout)
+			return exitOK
+		}
+		name, args = args[0], []string{"-h"}
+	}
+
+	c, ok := lookupCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	err := c.run(args)
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(os.Stderr, "%s: %v\nRun '%s help %s' for usage.\n", c.name, err, progName(), c.name)
+		return exitUsage
+	case errors.Is(err, errIncomplete):
+		log.Println(err)
+		return exitIncomplete
+	default:
+		log.Println(err)
+		return exitError
+	}
+}
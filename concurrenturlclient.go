@@ -0,0 +1,217 @@
+/*
+One shared, tuned HTTP client.
+
+Creating a new http.Client for every fetch gives no control over connection reuse: the default transport keeps only 2 idle connections per host, so with 100 workers almost every request opens a new TCP (and TLS) connection. Instead, the whole run shares httpClient, whose transport keeps an idle connection for every worker and attempts HTTP/2, where all requests share a single connection.
+
+The timeouts are separate, so a slow stage fails quickly without cutting off a large but healthy download:
+
+	-dial-timeout      establishing the TCP connection
+	-tls-timeout       the TLS handshake
+	-header-timeout    waiting for the response headers once the request is sent
+	-request-timeout   the whole request, including reading the body
+
+The bench command measures the effect: it starts a local test server that serves synthetic comics, crawls it with the worker pool and the shared client, and reports requests per second and the p50/p95/p99 latency.
+
+	go run concurrenturl*.go bench -n 2000 -workers 100 -latency 20ms
+	go run concurrenturl*.go bench -tls      over HTTPS, which negotiates HTTP/2
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type clientConfig struct {
+	Workers        int
+	DialTimeout    time.Duration
+	TLSTimeout     time.Duration
+	HeaderTimeout  time.Duration
+	RequestTimeout time.Duration
+}
+
+var defaultClientConfig = clientConfig{
+	Workers:        100,
+	DialTimeout:    5 * time.Second,
+	TLSTimeout:     5 * time.Second,
+	HeaderTimeout:  15 * time.Second,
+	RequestTimeout: time.Minute,
+}
+
+// httpClient is shared by every request of the run, main rebuilds it from the flags
+var httpClient = &http.Client{
+	Transport: transport,
+	Timeout:   defaultClientConfig.RequestTimeout,
+}
+
+func newBaseTransport(cfg clientConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          max(cfg.Workers, 100),
+		MaxIdleConnsPerHost:   cfg.Workers,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   cfg.TLSTimeout,
+		ResponseHeaderTimeout: cfg.HeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func (cfg *clientConfig) addFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", cfg.DialTimeout, "timeout for establishing a connection")
+	fs.DurationVar(&cfg.TLSTimeout, "tls-timeout", cfg.TLSTimeout, "timeout for the TLS handshake")
+	fs.DurationVar(&cfg.HeaderTimeout, "header-timeout", cfg.HeaderTimeout, "timeout for the response headers")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "timeout for a whole request including the body")
+}
+
+// latencyRecorder is a RoundTripper that remembers how long every request took until its headers arrived.
+type latencyRecorder struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	protos    map[string]int
+}
+
+func (l *latencyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := l.next.RoundTrip(req)
+	d := time.Since(start)
+
+	l.mu.Lock()
+	l.latencies = append(l.latencies, d)
+	if resp != nil {
+		l.protos[resp.Proto]++
+	}
+	l.mu.Unlock()
+	return resp, err
+}
+
+// percentile expects sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// benchServer answers like the xkcd JSON interface, with an optional delay per request.
+func benchServer(latest int, latency time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+
+		n := latest
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) == 2 {
+			n, _ = strconv.Atoi(parts[0])
+		} else if r.URL.Path != "/info.0.json" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Result{
+			Num:        n,
+			Title:      fmt.Sprintf("Comic %d", n),
+			SafeTitle:  fmt.Sprintf("Comic %d", n),
+			Alt:        strings.Repeat("alt text ", 20),
+			Transcript: strings.Repeat("[[A scene.]]\nCueball: A line.\n", 10),
+			Year:       "2010",
+			Month:      "1",
+			Day:        "1",
+		})
+	})
+}
+
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := fs.Int("n", 2000, "number of comics to crawl")
+	workers := fs.Int("workers", 100, "number of workers")
+	latency := fs.Duration("latency", 10*time.Millisecond, "delay the test server adds to every response")
+	useTLS := fs.Bool("tls", false, "serve over HTTPS, which lets the client negotiate HTTP/2")
+	cfg := defaultClientConfig
+	cfg.addFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *workers < 1 || *n < 1 {
+		return usagef("-workers and -n must be at least 1, got %d and %d", *workers, *n)
+	}
+	cfg.Workers = *workers
+
+	srv := httptest.NewUnstartedServer(benchServer(*n, *latency))
+	if *useTLS {
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	defer srv.Close()
+
+	base := newBaseTransport(cfg)
+	if *useTLS {
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		base.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	rec := &latencyRecorder{next: base, protos: make(map[string]int)}
+	transport = rec
+	httpClient = &http.Client{Transport: transport, Timeout: cfg.RequestTimeout}
+
+	// measure the client, not the politeness controls
+	source = newXkcdSource(srv.URL)
+	polite = newPoliteness(0, 1, *workers, defaultUserAgent, false)
+	concurrency = newAdaptiveLimit(*workers, *workers)
+
+	ctx := context.Background()
+	numbers, err := source.IDs(ctx, 1, *n)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	go allocateJobs(ctx, numbers)
+	go func() {
+		for range results {
+		}
+	}()
+	createWorkerPool(ctx, *workers)
+	elapsed := time.Since(start)
+
+	sorted := append([]time.Duration(nil), rec.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var protos []string
+	for proto, count := range rec.protos {
+		protos = append(protos, fmt.Sprintf("%s x%d", proto, count))
+	}
+	sort.Strings(protos)
+
+	fmt.Printf("%d requests with %d workers (%s, %v server latency) in %v\n", len(sorted), *workers, strings.Join(protos, ", "), *latency, elapsed.Round(time.Millisecond))
+	fmt.Printf("%.1f requests/second\n", float64(len(sorted))/elapsed.Seconds())
+	fmt.Printf("latency p50 %v  p95 %v  p99 %v\n",
+		percentile(sorted, 50).Round(time.Microsecond),
+		percentile(sorted, 95).Round(time.Microsecond),
+		percentile(sorted, 99).Round(time.Microsecond))
+	failures.report()
+	return nil
+}
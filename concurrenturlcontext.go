@@ -0,0 +1,57 @@
+/*
+Cancelling a crawl without losing the work already done.
+
+Every stage of the pipeline takes the same context.Context: fetch attaches it to the HTTP request so an in-flight download is aborted, fetchWithRetry stops waiting for its backoff, allocateJobs stops queueing numbers and the workers drain the jobs channel without fetching. The results channel is then closed as usual, so getResults still ends normally with everything that arrived before the cancellation.
+
+The context is canceled by Ctrl-C (SIGINT), SIGTERM or the optional -timeout deadline. Whatever is in resultCollection at that point is merged into xkcd.json as a checkpoint; running the sync mode afterwards fetches only the comics that are still missing.
+
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/*
+crawlContext returns the context for a whole run. After the first signal the default signal handling is restored, so pressing Ctrl-C a second time kills the process immediately instead of waiting for the checkpoint.
+*/
+
+func crawlContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	cancel := stop
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = func() {
+			cancelTimeout()
+			stop()
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, cancel
+}
+
+/*
+writeCheckpoint merges the partial results into the index on disk instead of overwriting it, so an interrupted full crawl never replaces a complete xkcd.json with a smaller one.
+*/
+
+func writeCheckpoint(collected []Result) error {
+	index, err := updateIndex(collected)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("interrupted: checkpoint of %d comics written to %s, run sync to resume\n", len(index), indexFile)
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+Publication dates as real dates.
+
+The JSON interface returns the date of a comic as three strings ("year": "2006", "month": "1", "day": "1"), which makes every consumer parse, pad and compare strings. Result keeps those fields as they are, and additionally carries Published as a time.Time:
+
+  - decoding reads "date" when present, otherwise builds the date from year/month/day, so the upstream API and older xkcd.json files both work
+  - encoding writes the three strings and "date" in ISO form ("2006-01-02"), so existing readers keep working
+
+The dates command lists comics by date range, weekday or year, and prints a histogram of comics per year and month:
+
+	go run concurrenturl*.go dates -from 2010-01-01 -to 2010-03-31
+	go run concurrenturl*.go dates -weekday wednesday -year 2012
+	go run concurrenturl*.go dates -histogram
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// resultFields has the fields of Result without its JSON methods, so they can be used inside them.
+type resultFields Result
+
+type resultJSON struct {
+	resultFields
+	Date string `json:"date,omitempty"`
+}
+
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var aux resultJSON
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*r = Result(aux.resultFields)
+
+	if aux.Date != "" {
+		if t, err := time.Parse(dateLayout, aux.Date); err == nil {
+			r.Published = t
+			return nil
+		}
+	}
+	// an invalid or incomplete date is left as the zero time, the strings are still there
+	r.Published, _ = parseDate(r.Year, r.Month, r.Day)
+	return nil
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	aux := resultJSON{resultFields: resultFields(r)}
+	if !r.Published.IsZero() {
+		aux.Date = r.Published.Format(dateLayout)
+	}
+	return json.Marshal(aux)
+}
+
+// parseDate builds a date from the upstream strings and rejects dates that do not exist, like 2010-02-30.
+func parseDate(year, month, day string) (time.Time, error) {
+	y, err1 := strconv.Atoi(year)
+	m, err2 := strconv.Atoi(month)
+	d, err3 := strconv.Atoi(day)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q-%q-%q", year, month, day)
+	}
+
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if t.Year() != y || t.Month() != time.Month(m) || t.Day() != d {
+		return time.Time{}, fmt.Errorf("invalid date %s-%s-%s", year, month, day)
+	}
+	return t, nil
+}
+
+// comicsBetween returns the comics published from..to, both days included.
+func comicsBetween(index []Result, from, to time.Time) []Result {
+	var list []Result
+	for _, r := range index {
+		if !r.Published.IsZero() && !r.Published.Before(from) && !r.Published.After(to) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func comicsOnWeekday(index []Result, day time.Weekday) []Result {
+	var list []Result
+	for _, r := range index {
+		if !r.Published.IsZero() && r.Published.Weekday() == day {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func comicsInYear(index []Result, year int) []Result {
+	var list []Result
+	for _, r := range index {
+		if !r.Published.IsZero() && r.Published.Year() == year {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+type dateHistogram struct {
+	years  map[int]int
+	months map[int]map[time.Month]int
+}
+
+func histogram(index []Result) dateHistogram {
+	h := dateHistogram{years: make(map[int]int), months: make(map[int]map[time.Month]int)}
+	for _, r := range index {
+		if r.Published.IsZero() {
+			continue
+		}
+		y := r.Published.Year()
+		h.years[y]++
+		if h.months[y] == nil {
+			h.months[y] = make(map[time.Month]int)
+		}
+		h.months[y][r.Published.Month()]++
+	}
+	return h
+}
+
+// print shows one line per year with a bar, followed by the twelve monthly counts.
+func (h dateHistogram) print() {
+	var years []int
+	most := 0
+	for y, n := range h.years {
+		years = append(years, y)
+		most = max(most, n)
+	}
+	sort.Ints(years)
+
+	fmt.Printf("%-6s %5s  %s\n", "year", "total", "Jan Feb Mar Apr May Jun Jul Aug Sep Oct Nov Dec")
+	for _, y := range years {
+		var months []string
+		for m := time.January; m <= time.December; m++ {
+			months = append(months, fmt.Sprintf("%3d", h.months[y][m]))
+		}
+		bar := strings.Repeat("#", h.years[y]*30/max(most, 1))
+		fmt.Printf("%-6d %5d  %s  %s\n", y, h.years[y], strings.Join(months, " "), bar)
+	}
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if strings.ToLower(s) == name || strings.ToLower(s) == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+func datesCommand(args []string) error {
+	fs := flag.NewFlagSet("dates", flag.ExitOnError)
+	addIndexFlag(fs)
+	from := fs.String("from", "", "first publication date, YYYY-MM-DD")
+	to := fs.String("to", "", "last publication date, YYYY-MM-DD")
+	weekday := fs.String("weekday", "", "only comics published on this weekday")
+	year := fs.Int("year", 0, "only comics published in this year")
+	hist := fs.Bool("histogram", false, "print comics per year and month instead of listing them")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var index []Result
+	var err error
+	if isBinaryIndex(indexFile) && *year != 0 {
+		// only the comics of that year are decoded (see concurrenturlbinary.go)
+		index, err = readBinaryYear(indexFile, *year)
+	} else {
+		index, err = loadIndex(indexFile)
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+
+	if *from != "" || *to != "" {
+		start, end := time.Time{}, time.Now()
+		if *from != "" {
+			if start, err = time.Parse(dateLayout, *from); err != nil {
+				return err
+			}
+		}
+		if *to != "" {
+			if end, err = time.Parse(dateLayout, *to); err != nil {
+				return err
+			}
+		}
+		index = comicsBetween(index, start, end)
+	}
+	if *weekday != "" {
+		day, err := parseWeekday(*weekday)
+		if err != nil {
+			return err
+		}
+		index = comicsOnWeekday(index, day)
+	}
+	if *year != 0 {
+		index = comicsInYear(index, *year)
+	}
+
+	if *hist {
+		histogram(index).print()
+		return nil
+	}
+	for _, r := range index {
+		date, day := "unknown   ", ""
+		if !r.Published.IsZero() {
+			date, day = r.Published.Format(dateLayout), r.Published.Weekday().String()
+		}
+		fmt.Printf("%s  %-9s #%-5d %s\n", date, day, r.Num, r.Title)
+	}
+	fmt.Printf("%d comics\n", len(index))
+	return nil
+}
@@ -0,0 +1,305 @@
+/*
+Comparing two snapshots of the index.
+
+Every crawl overwrites xkcd.json, so a transcript or alt text that was changed upstream goes unnoticed. Keep a copy of the old index and compare it with the new one:
+
+	cp xkcd.json xkcd.old.json && go run concurrenturl*.go sync
+	go run concurrenturl*.go diff xkcd.old.json xkcd.json
+	go run concurrenturl*.go diff -json xkcd.old.json xkcd.json
+
+Comics are matched by number and reported as added, removed or modified. For a modified comic every changed field is listed with its old and new value; text fields that span several lines or are long, like Transcript, are shown as a unified diff instead. -json prints the same as JSON, for change notifications.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	diffContext  = 3       // unchanged lines around every change in a unified diff
+	longText     = 80      // values longer than this are diffed line by line
+	maxDiffCells = 1 << 20 // when len(a)*len(b) is larger, the diff does not look for common lines
+	diffIndent   = "    "
+)
+
+type comicRef struct {
+	Num   int    `json:"num"`
+	Title string `json:"title"`
+}
+
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	// a unified diff of Old and New for long text fields
+	Diff string `json:"diff,omitempty"`
+}
+
+type comicChange struct {
+	comicRef
+	Fields []fieldChange `json:"fields"`
+}
+
+type indexDiff struct {
+	Added    []comicRef    `json:"added"`
+	Removed  []comicRef    `json:"removed"`
+	Modified []comicChange `json:"modified"`
+}
+
+// diffFields are the fields that are compared, in the order they are reported.
+func diffFields(r Result) []struct{ name, value string } {
+	image := ""
+	if r.Image != nil {
+		image = r.Image.SHA256
+	}
+	return []struct{ name, value string }{
+		{"title", r.Title},
+		{"safe_title", r.SafeTitle},
+		{"year", r.Year},
+		{"month", r.Month},
+		{"day", r.Day},
+		{"img", r.Img},
+		{"image", image},
+		{"link", r.Link},
+		{"news", r.News},
+		{"alt", r.Alt},
+		{"transcript", r.Transcript},
+	}
+}
+
+func diffIndexes(old, cur []Result) indexDiff {
+	d := indexDiff{Added: []comicRef{}, Removed: []comicRef{}, Modified: []comicChange{}}
+
+	oldByNum := make(map[int]Result, len(old))
+	for _, r := range old {
+		oldByNum[r.Num] = r
+	}
+	newByNum := make(map[int]Result, len(cur))
+	for _, r := range cur {
+		newByNum[r.Num] = r
+	}
+
+	for _, r := range old {
+		if _, ok := newByNum[r.Num]; !ok {
+			d.Removed = append(d.Removed, comicRef{r.Num, r.Title})
+		}
+	}
+	for _, r := range cur {
+		o, ok := oldByNum[r.Num]
+		if !ok {
+			d.Added = append(d.Added, comicRef{r.Num, r.Title})
+			continue
+		}
+
+		var fields []fieldChange
+		oldFields := diffFields(o)
+		for i, f := range diffFields(r) {
+			before := oldFields[i].value
+			if before == f.value {
+				continue
+			}
+			c := fieldChange{Field: f.name, Old: before, New: f.value}
+			if isLongText(before) || isLongText(f.value) {
+				c.Diff = unifiedDiff(before, f.value)
+			}
+			fields = append(fields, c)
+		}
+		if len(fields) > 0 {
+			d.Modified = append(d.Modified, comicChange{comicRef{r.Num, r.Title}, fields})
+		}
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Num < d.Added[j].Num })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Num < d.Removed[j].Num })
+	sort.Slice(d.Modified, func(i, j int) bool { return d.Modified[i].Num < d.Modified[j].Num })
+	return d
+}
+
+func isLongText(s string) bool {
+	return len(s) > longText || strings.Contains(s, "\n")
+}
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// lineDiff turns a into b with the fewest removed and added lines, using the longest common subsequence.
+func lineDiff(a, b []string) []diffLine {
+	var out []diffLine
+	if len(a)*len(b) > maxDiffCells {
+		for _, l := range a {
+			out = append(out, diffLine{'-', l})
+		}
+		for _, l := range b {
+			out = append(out, diffLine{'+', l})
+		}
+		return out
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	return out
+}
+
+// unifiedDiff formats the changes between a and b as hunks with diffContext lines of context, like diff -u.
+func unifiedDiff(a, b string) string {
+	lines := lineDiff(strings.Split(a, "\n"), strings.Split(b, "\n"))
+
+	// the line number in a and b at which every diff line starts
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for k, l := range lines {
+		aPos[k+1], bPos[k+1] = aPos[k], bPos[k]
+		if l.op != '+' {
+			aPos[k+1]++
+		}
+		if l.op != '-' {
+			bPos[k+1]++
+		}
+	}
+
+	var sb strings.Builder
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+
+		// changes closer than twice the context share a hunk
+		last := first
+		for k := first; k < len(lines) && k-last <= 2*diffContext; k++ {
+			if lines[k].op != ' ' {
+				last = k
+			}
+		}
+
+		lo := max(first-diffContext, start)
+		hi := min(last+diffContext+1, len(lines))
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aPos[lo], aPos[hi]-aPos[lo]), hunkRange(bPos[lo], bPos[hi]-bPos[lo]))
+		for _, l := range lines[lo:hi] {
+			sb.WriteByte(l.op)
+			sb.WriteString(l.text)
+			sb.WriteByte('\n')
+		}
+		start = hi
+	}
+	return sb.String()
+}
+
+// hunkRange is start,length with 1-based lines, an empty range names the line before it.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func (d indexDiff) print() {
+	for _, c := range d.Added {
+		fmt.Printf("added    #%d %s\n", c.Num, c.Title)
+	}
+	for _, c := range d.Removed {
+		fmt.Printf("removed  #%d %s\n", c.Num, c.Title)
+	}
+	for _, c := range d.Modified {
+		fmt.Printf("modified #%d %s\n", c.Num, c.Title)
+		for _, f := range c.Fields {
+			if f.Diff == "" {
+				fmt.Printf("%s%s: %q -> %q\n", diffIndent, f.Field, f.Old, f.New)
+				continue
+			}
+			fmt.Printf("%s%s:\n", diffIndent, f.Field)
+			for _, l := range strings.SplitAfter(strings.TrimSuffix(f.Diff, "\n"), "\n") {
+				fmt.Printf("%s%s%s", diffIndent, diffIndent, l)
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d modified\n", len(d.Added), len(d.Removed), len(d.Modified))
+}
+
+func loadSnapshot(path string) ([]Result, error) {
+	// loadIndex treats a missing file as an empty index, which would report every comic as added
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return loadIndex(path)
+}
+
+func diffCommand(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the differences as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usagef("need two index files, the old and the new one")
+	}
+
+	old, err := loadSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cur, err := loadSnapshot(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	d := diffIndexes(old, cur)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(d)
+	}
+	d.print()
+	return nil
+}
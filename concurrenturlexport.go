@@ -0,0 +1,303 @@
+/*
+Exporting the index to other formats.
+
+Instead of every consumer writing its own converter for xkcd.json, the export command renders it through an Exporter:
+
+	csv     one row per comic; encoding/csv takes care of quoting the multi-line Transcript and Alt
+	atom    an Atom 1.0 feed of the newest -n comics
+	html    a static site: index.html by year and one page per comic under comics/, rendered with html/template
+
+	go run concurrenturl*.go export csv atom html
+	go run concurrenturl*.go export -n 50 -o feed.xml atom
+
+Each format writes to its default output (xkcd.csv, xkcd.atom, site/) unless -o is given, which only works for a single format. A new format only needs an Exporter and an entry in exporters.
+
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Exporter interface {
+	// DefaultOutput is the file or directory written when no -o is given.
+	DefaultOutput() string
+	Export(index []Result, out string) error
+}
+
+type exportOptions struct {
+	FeedEntries int
+}
+
+var exporters = map[string]func(opts exportOptions) Exporter{
+	"csv":  func(exportOptions) Exporter { return csvExporter{} },
+	"atom": func(opts exportOptions) Exporter { return atomExporter{entries: opts.FeedEntries} },
+	"html": func(exportOptions) Exporter { return htmlExporter{} },
+}
+
+// comicURL is the page of a comic on the site itself.
+func comicURL(num int) string {
+	return fmt.Sprintf("%s/%d/", Url, num)
+}
+
+type csvExporter struct{}
+
+func (csvExporter) DefaultOutput() string { return "xkcd.csv" }
+
+func (csvExporter) Export(index []Result, out string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"num", "date", "year", "month", "day", "title", "safe_title", "alt", "transcript", "img", "link", "news"})
+	for _, r := range index {
+		date := ""
+		if !r.Published.IsZero() {
+			date = r.Published.Format(dateLayout)
+		}
+		w.Write([]string{strconv.Itoa(r.Num), date, r.Year, r.Month, r.Day, r.Title, r.SafeTitle, r.Alt, r.Transcript, r.Img, r.Link, r.News})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type atomExporter struct {
+	entries int
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary"`
+	Content atomText `xml:"content"`
+}
+
+func (atomExporter) DefaultOutput() string { return "xkcd.atom" }
+
+func (e atomExporter) Export(index []Result, out string) error {
+	newest := append([]Result(nil), index...)
+	sort.Slice(newest, func(i, j int) bool { return newest[i].Num > newest[j].Num })
+	newest = newest[:min(e.entries, len(newest))]
+
+	feed := atomFeed{
+		Title:  "xkcd",
+		ID:     Url + "/",
+		Link:   atomLink{Href: Url + "/"},
+		Author: atomAuthor{Name: "Randall Munroe"},
+	}
+
+	var updated time.Time
+	for _, r := range newest {
+		if r.Published.After(updated) {
+			updated = r.Published
+		}
+
+		// the comic itself, with the alt text as a tooltip like on the site
+		content := fmt.Sprintf(`<img src="%s" title="%s" alt="%s"/>`,
+			template.HTMLEscapeString(r.Img), template.HTMLEscapeString(r.Alt), template.HTMLEscapeString(r.Title))
+
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   r.Title,
+			ID:      comicURL(r.Num),
+			Link:    atomLink{Href: comicURL(r.Num), Rel: "alternate"},
+			Updated: r.Published.Format(time.RFC3339),
+			Summary: r.Alt,
+			Content: atomText{Type: "html", Body: content},
+		})
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("xml err: %v", err)
+	}
+	return os.WriteFile(out, append([]byte(xml.Header), data...), 0644)
+}
+
+type htmlExporter struct{}
+
+func (htmlExporter) DefaultOutput() string { return "site" }
+
+var siteIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>xkcd offline</title></head>
+<body>
+<h1>xkcd offline</h1>
+{{range .}}<h2>{{.Year}}</h2>
+<ul>
+{{range .Comics}}<li><a href="comics/{{.Num}}.html">#{{.Num}} {{.Title}}</a></li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+var sitePage = template.Must(template.New("comic").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>xkcd #{{.Comic.Num}}: {{.Comic.Title}}</title></head>
+<body>
+<p><a href="../index.html">index</a>{{with .Prev}} | <a href="{{.Num}}.html">&lt; #{{.Num}}</a>{{end}}{{with .Next}} | <a href="{{.Num}}.html">#{{.Num}} &gt;</a>{{end}}</p>
+<h1>#{{.Comic.Num}}: {{.Comic.Title}}</h1>
+<p>{{.Date}}</p>
+<img src="{{.Comic.Img}}" title="{{.Comic.Alt}}" alt="{{.Comic.Title}}">
+<p><em>{{.Comic.Alt}}</em></p>
+{{with .Comic.Transcript}}<h2>Transcript</h2>
+<pre>{{.}}</pre>
+{{end}}</body>
+</html>
+`))
+
+type yearGroup struct {
+	Year   string
+	Comics []Result
+}
+
+type comicPage struct {
+	Comic      Result
+	Date       string
+	Prev, Next *Result
+}
+
+func (htmlExporter) Export(index []Result, out string) error {
+	sorted := append([]Result(nil), index...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Num < sorted[j].Num })
+
+	if err := os.MkdirAll(filepath.Join(out, "comics"), 0755); err != nil {
+		return err
+	}
+
+	// newest year first, comics in order inside a year
+	var years []yearGroup
+	for i := len(sorted) - 1; i >= 0; i-- {
+		r := sorted[i]
+		if len(years) == 0 || years[len(years)-1].Year != r.Year {
+			years = append(years, yearGroup{Year: r.Year})
+		}
+		g := &years[len(years)-1]
+		g.Comics = append([]Result{r}, g.Comics...)
+	}
+	if err := renderFile(filepath.Join(out, "index.html"), siteIndex, years); err != nil {
+		return err
+	}
+
+	for i, r := range sorted {
+		p := comicPage{Comic: r}
+		if !r.Published.IsZero() {
+			p.Date = r.Published.Format("January 2, 2006")
+		}
+		if i > 0 {
+			p.Prev = &sorted[i-1]
+		}
+		if i < len(sorted)-1 {
+			p.Next = &sorted[i+1]
+		}
+		if err := renderFile(filepath.Join(out, "comics", strconv.Itoa(r.Num)+".html"), sitePage, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderFile(path string, t *template.Template, data interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(f, data); err != nil {
+		f.Close()
+		return fmt.Errorf("template err: %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	addIndexFlag(fs)
+	out := fs.String("o", "", "output file or directory, only for a single format")
+	entries := fs.Int("n", 20, "number of comics in the Atom feed")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *entries < 1 {
+		return usagef("-n must be at least 1, got %d", *entries)
+	}
+
+	formats := fs.Args()
+	if len(formats) == 0 {
+		var names []string
+		for name := range exporters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return usagef("no format given, available: %s", strings.Join(names, " "))
+	}
+	if *out != "" && len(formats) > 1 {
+		return usagef("-o can only be used with a single format")
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+
+	for _, name := range formats {
+		newExporter, ok := exporters[name]
+		if !ok {
+			return usagef("unknown export format %q", name)
+		}
+		e := newExporter(exportOptions{FeedEntries: *entries})
+
+		path := *out
+		if path == "" {
+			path = e.DefaultOutput()
+		}
+		if err := e.Export(index, path); err != nil {
+			return fmt.Errorf("export %s: %w", name, err)
+		}
+		fmt.Printf("%s: written to %s\n", name, path)
+	}
+	return nil
+}
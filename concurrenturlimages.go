@@ -0,0 +1,251 @@
+/*
+Mirroring comic images.
+
+Result.Img is only a URL, so showing a comic from the "offline" index still needs the network. With -images the workers also download each Img into a local content-addressed store: the file is named by the SHA-256 of its bytes, so the same image is only ever stored once and a changed file can be detected by hashing it again.
+
+	go run concurrenturl*.go -images images
+	go run concurrenturl*.go sync -images images
+	go run concurrenturl*.go verify -images images
+
+The hash, byte size, MIME type and pixel dimensions are recorded in the index as the "image" field. Images that are already in the store (known from the existing xkcd.json) are not downloaded again. verify hashes every stored file and reports the ones that are missing or corrupted, along with its checks of the index itself (see concurrenturlverify.go).
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type ImageFile struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	MIME   string `json:"mime"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// largest image we are willing to download, the biggest xkcd comics are a few megabytes
+const maxImageSize = 50 << 20
+
+type imageStore struct {
+	dir string
+
+	mu    sync.Mutex
+	known map[string]ImageFile // by image URL, from the existing index
+}
+
+// mirror is nil unless -images is given
+var mirror *imageStore
+
+func newImageStore(dir string, index []Result) (*imageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &imageStore{dir: dir, known: make(map[string]ImageFile)}
+	for _, r := range index {
+		if r.Image != nil && r.Img != "" {
+			s.known[r.Img] = *r.Image
+		}
+	}
+	return s, nil
+}
+
+func (s *imageStore) path(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+// lookup returns the stored image for url if the index knows it and the file is still there.
+func (s *imageStore) lookup(url string) (ImageFile, bool) {
+	s.mu.Lock()
+	img, ok := s.known[url]
+	s.mu.Unlock()
+	if !ok {
+		return ImageFile{}, false
+	}
+
+	st, err := os.Stat(s.path(img.SHA256))
+	if err != nil || st.Size() != img.Size {
+		return ImageFile{}, false
+	}
+	return img, true
+}
+
+/*
+store downloads url into the store. The image is hashed and inspected in memory, then written under a temporary name and renamed, so a half-written file never carries a valid hash as its name.
+*/
+
+func (s *imageStore) store(ctx context.Context, url string) (ImageFile, error) {
+	if img, ok := s.lookup(url); ok {
+		return img, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return ImageFile{}, fmt.Errorf("http request: %w", err)
+	}
+	resp, err := politeDo(ctx, httpClient, req)
+	if err != nil {
+		return ImageFile{}, fmt.Errorf("http err: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ImageFile{}, &statusError{Code: resp.StatusCode}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return ImageFile{}, fmt.Errorf("http err: %w", err)
+	}
+	if len(data) > maxImageSize {
+		return ImageFile{}, fmt.Errorf("image too large: %s", url)
+	}
+
+	img := describeImage(data)
+
+	path := s.path(img.SHA256)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := writeFileAtomic(path, data); err != nil {
+			return ImageFile{}, err
+		}
+	}
+
+	s.mu.Lock()
+	s.known[url] = img
+	s.mu.Unlock()
+	return img, nil
+}
+
+// writeFileAtomic writes data next to path under a unique temporary name and renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// describeImage hashes the bytes and reads the format and dimensions from the image header.
+func describeImage(data []byte) ImageFile {
+	sum := sha256.Sum256(data)
+	img := ImageFile{
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(data)),
+		MIME:   http.DetectContentType(data),
+	}
+
+	// unknown formats (svg, webp) are stored without dimensions
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		img.Width, img.Height = cfg.Width, cfg.Height
+	}
+	return img
+}
+
+// mirrorImage is the optional image stage of the worker, a failed download keeps the result without image data.
+func mirrorImage(ctx context.Context, r *Result) {
+	if mirror == nil || r.Img == "" {
+		return
+	}
+
+	img, err := mirror.store(ctx, r.Img)
+	if err != nil {
+		log.Printf("error in mirroring image of #%d: %v\n", r.Num, err)
+		return
+	}
+	r.Image = &img
+}
+
+/*
+mirrorMissing downloads the images of comics that are already in the index but were crawled without -images, so turning on mirroring for an existing index backfills it.
+*/
+
+func mirrorMissing(ctx context.Context, index []Result, noOfWorkers int) {
+	if mirror == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, noOfWorkers)
+	for i := range index {
+		if index[i].Image != nil || index[i].Img == "" {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			mirrorImage(ctx, r)
+			<-sem
+		}(&index[i])
+	}
+	wg.Wait()
+}
+
+type imageProblem struct {
+	Num     int    `json:"num"`
+	Problem string `json:"problem"`
+}
+
+// verifyImages checks every stored image of the index against its recorded hash and size.
+func verifyImages(dir string, index []Result) (problems []imageProblem, unmirrored int) {
+	for _, r := range index {
+		if r.Image == nil {
+			if r.Img != "" {
+				unmirrored++
+			}
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, r.Image.SHA256))
+		if errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, imageProblem{r.Num, "missing"})
+			continue
+		}
+		if err != nil {
+			problems = append(problems, imageProblem{r.Num, err.Error()})
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		switch {
+		case int64(len(data)) != r.Image.Size:
+			problems = append(problems, imageProblem{r.Num, fmt.Sprintf("corrupted: %d bytes, expected %d", len(data), r.Image.Size)})
+		case hex.EncodeToString(sum[:]) != r.Image.SHA256:
+			problems = append(problems, imageProblem{r.Num, "corrupted: sha256 mismatch"})
+		}
+	}
+	return problems, unmirrored
+}
@@ -0,0 +1,164 @@
+/*
+Streaming results to a JSON Lines log.
+
+Keeping every Result in resultCollection until the end means a crash at comic 2999 loses the whole run, and memory grows with the index. With -jsonl each result is appended to the log as one JSON object per line as soon as it comes out of the results channel, and the file is fsync'd every few results so a crash loses at most the last handful.
+
+	go run concurrenturl*.go -jsonl xkcd.jsonl
+	go run concurrenturl*.go compact -jsonl xkcd.jsonl
+
+The rest of our tooling expects the sorted, pretty-printed xkcd.json, so the log is compacted into it at the end of the run: log entries are merged into the existing index (a later line for the same Num wins) and the log is removed. If the process died before that, the compact command does the same by hand. A truncated last line, as left by a crash in the middle of a write, is skipped.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// how often appended results are flushed to disk
+const (
+	syncEvery    = 50
+	syncInterval = 5 * time.Second
+)
+
+type jsonlWriter struct {
+	f        *os.File
+	w        *bufio.Writer
+	pending  int
+	lastSync time.Time
+}
+
+// stream is nil unless -jsonl is given, it then takes the place of resultCollection among the sinks (see concurrenturlsink.go)
+var stream *jsonlWriter
+
+func openJSONL(path string) (*jsonlWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlWriter{f: f, w: bufio.NewWriter(f), lastSync: time.Now()}, nil
+}
+
+func (j *jsonlWriter) Write(r Result) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	j.w.Write(line)
+	if err := j.w.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	j.pending++
+	if j.pending >= syncEvery || time.Since(j.lastSync) >= syncInterval {
+		return j.sync()
+	}
+	return nil
+}
+
+func (j *jsonlWriter) sync() error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	j.pending, j.lastSync = 0, time.Now()
+	return j.f.Sync()
+}
+
+func (j *jsonlWriter) Close() error {
+	if err := j.sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// readJSONL reads every complete result of a log, skipping a truncated last line.
+func readJSONL(path string) ([]Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []Result
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		last := errors.Is(err, io.EOF)
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var res Result
+			if jerr := json.Unmarshal(line, &res); jerr != nil {
+				// only the very last line may be broken, anything after it means a corrupt log
+				if _, perr := r.Peek(1); !errors.Is(perr, io.EOF) {
+					return nil, fmt.Errorf("json err: %s:%d: %v", path, lineNo, jerr)
+				}
+				log.Printf("skipping truncated last line %d of %s\n", lineNo, path)
+			} else {
+				list = append(list, res)
+			}
+		}
+
+		if last {
+			return list, nil
+		}
+	}
+}
+
+/*
+compactLog merges the log into xkcd.json and removes it. mergeResults keeps the last result for a Num, so a comic that was fetched twice ends up with its newest version.
+*/
+
+func compactLog(path string) ([]Result, error) {
+	logged, err := readJSONL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	index = mergeResults(index, logged)
+	if err := writeIndex(index); err != nil {
+		return nil, err
+	}
+
+	log.Printf("compacted %d logged results into %s (%d comics)\n", len(logged), indexFile, len(index))
+	return index, os.Remove(path)
+}
+
+// finishStream closes the log of the run and compacts it into the index.
+func finishStream(path string) ([]Result, error) {
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	stream = nil
+	return compactLog(path)
+}
+
+func compactCommand(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	addIndexFlag(fs)
+	path := fs.String("jsonl", "xkcd.jsonl", "JSON Lines log to compact into "+indexFile)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	_, err := compactLog(*path)
+	return err
+}
@@ -0,0 +1,134 @@
+/*
+The failure manifest.
+
+The failure report at the end of a run is gone as soon as the terminal is closed. Every run therefore also writes xkcd.failures.json next to the index (data/xkcd.failures.json for -index data/xkcd.json): one entry per comic that could not be fetched, with the HTTP status, the error class (see concurrenturlretry.go), the number of attempts, the time and the error message.
+
+The manifest is updated, not replaced: entries for comics this run did not touch are kept, comics that were fetched successfully this time are removed, and new failures replace older entries for the same comic. An empty manifest is deleted.
+
+retry-failed reads the manifest and fetches only those comics, merging the successes into xkcd.json. Missing comics (404) are skipped unless -missing is given, as they usually do not exist at all.
+
+	go run concurrenturl*.go retry-failed
+	go run concurrenturl*.go retry-failed -missing
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// failuresFile is the manifest next to the index, xkcd.failures.json for xkcd.json, so -index moves both.
+func failuresFile() string {
+	return strings.TrimSuffix(indexFile, filepath.Ext(indexFile)) + ".failures.json"
+}
+
+type manifestEntry struct {
+	Num      int        `json:"num"`
+	Status   int        `json:"status,omitempty"`
+	Class    errorClass `json:"class"`
+	Attempts int        `json:"attempts"`
+	Time     time.Time  `json:"time"`
+	Error    string     `json:"error"`
+}
+
+func loadManifest(path string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("json err: %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// save merges the failures of this run into the manifest at path.
+func (f *failureLog) save(path string) error {
+	old, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	list := f.list()
+
+	f.mu.Lock()
+	byNum := make(map[int]manifestEntry, len(old)+len(list))
+	for _, e := range old {
+		if !f.fetched[e.Num] {
+			byNum[e.Num] = e
+		}
+	}
+	f.mu.Unlock()
+
+	for _, e := range list {
+		byNum[e.Num] = manifestEntry{
+			Num:      e.Num,
+			Status:   e.Status,
+			Class:    e.Class,
+			Attempts: e.Attempts,
+			Time:     e.Time,
+			Error:    e.Err.Error(),
+		}
+	}
+
+	if len(byNum) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	entries := make([]manifestEntry, 0, len(byNum))
+	for _, e := range byNum {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Num < entries[j].Num })
+
+	data, err := json.MarshalIndent(entries, "", "    ")
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+func retryFailed(ctx context.Context, includeMissing bool, noOfWorkers int, jsonlPath string) error {
+	entries, err := loadManifest(failuresFile())
+	if err != nil {
+		return err
+	}
+
+	var numbers []int
+	for _, e := range entries {
+		if e.Class != classMissing || includeMissing {
+			numbers = append(numbers, e.Num)
+		}
+	}
+	log.Printf("%d failures in %s, retrying %d\n", len(entries), failuresFile(), len(numbers))
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	if index, err = fetchInto(ctx, index, numbers, noOfWorkers, jsonlPath); err != nil {
+		return err
+	}
+	return writeIndex(index)
+}
@@ -0,0 +1,241 @@
+/*
+Live progress and metrics.
+
+"Retrieving issue #N" in the order results arrive says little about a long crawl. On a terminal the crawl instead redraws one progress line twice a second:
+
+	1234/2999  41%  85.3/s  ETA 20s  3 errors
+
+-progress=false turns it off, and it is off when stderr is not a terminal, where the old lines are printed as before.
+
+With -metrics the crawl also serves its counters in the Prometheus text format, for a dashboard to scrape while it runs:
+
+	go run concurrenturl*.go -metrics localhost:9100
+	curl localhost:9100/metrics
+
+	xkcd_comics_planned                      comics to fetch in this run
+	xkcd_comics_fetched_total                comics fetched
+	xkcd_comics_failed_total                 comics that could not be fetched
+	xkcd_retries_total                       attempts that were retried
+	xkcd_http_requests_total{code}           responses by status code, code="error" for requests without a response
+	xkcd_http_request_duration_seconds       histogram of the time until the response headers
+	xkcd_http_response_bytes_total           bytes of response bodies read
+	xkcd_queue_depth{queue}                  results waiting in the jobs and results channels
+	xkcd_concurrency_limit                   requests allowed in flight (see concurrenturladaptive.go)
+
+The HTTP numbers are measured below the cache (see concurrenturlcache.go), so a revalidated comic counts as a 304 with an empty body, as it went over the network.
+
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram, in seconds
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const progressInterval = 500 * time.Millisecond
+
+type crawlMetrics struct {
+	total   atomic.Int64
+	fetched atomic.Int64
+	failed  atomic.Int64
+	retries atomic.Int64
+	bytes   atomic.Int64
+
+	mu         sync.Mutex
+	start      time.Time
+	statuses   map[string]int64
+	buckets    []int64 // not cumulative, one more than latencyBuckets for +Inf
+	latencySum float64
+	jobs       chan Job
+	results    chan Result
+}
+
+var metrics = newCrawlMetrics()
+
+// showProgress replaces the "Retrieving issue" lines with the progress line, main sets it from -progress
+var showProgress bool
+
+func newCrawlMetrics() *crawlMetrics {
+	return &crawlMetrics{
+		statuses: make(map[string]int64),
+		buckets:  make([]int64, len(latencyBuckets)+1),
+	}
+}
+
+// begin adds the comics of a pool run and watches its channels.
+func (m *crawlMetrics) begin(numbers int, jobs chan Job, results chan Result) {
+	m.total.Add(int64(numbers))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		m.start = time.Now()
+	}
+	m.jobs, m.results = jobs, results
+}
+
+func (m *crawlMetrics) observe(status string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[status]++
+	s := latency.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	m.buckets[i]++
+	m.latencySum += s
+}
+
+// metricsTransport records every request that goes through it.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		metrics.observe("error", time.Since(start))
+		return nil, err
+	}
+	metrics.observe(strconv.Itoa(resp.StatusCode), time.Since(start))
+	resp.Body = &countingBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	metrics.bytes.Add(int64(n))
+	return n, err
+}
+
+// writePrometheus writes every metric in the Prometheus text exposition format.
+func (m *crawlMetrics) writePrometheus(w io.Writer) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("xkcd_comics_planned", "gauge", "Comics to fetch in this run.")
+	fmt.Fprintf(w, "xkcd_comics_planned %d\n", m.total.Load())
+	metric("xkcd_comics_fetched_total", "counter", "Comics fetched.")
+	fmt.Fprintf(w, "xkcd_comics_fetched_total %d\n", m.fetched.Load())
+	metric("xkcd_comics_failed_total", "counter", "Comics that could not be fetched.")
+	fmt.Fprintf(w, "xkcd_comics_failed_total %d\n", m.failed.Load())
+	metric("xkcd_retries_total", "counter", "Fetch attempts that were retried.")
+	fmt.Fprintf(w, "xkcd_retries_total %d\n", m.retries.Load())
+	metric("xkcd_http_response_bytes_total", "counter", "Bytes of response bodies read.")
+	fmt.Fprintf(w, "xkcd_http_response_bytes_total %d\n", m.bytes.Load())
+
+	m.mu.Lock()
+	statuses := make([]string, 0, len(m.statuses))
+	for code := range m.statuses {
+		statuses = append(statuses, code)
+	}
+	sort.Strings(statuses)
+	metric("xkcd_http_requests_total", "counter", "HTTP responses by status code.")
+	var count int64
+	for _, code := range statuses {
+		fmt.Fprintf(w, "xkcd_http_requests_total{code=%q} %d\n", code, m.statuses[code])
+	}
+
+	metric("xkcd_http_request_duration_seconds", "histogram", "Time until the response headers arrived.")
+	for i, le := range latencyBuckets {
+		count += m.buckets[i]
+		fmt.Fprintf(w, "xkcd_http_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, count)
+	}
+	count += m.buckets[len(latencyBuckets)]
+	fmt.Fprintf(w, "xkcd_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "xkcd_http_request_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "xkcd_http_request_duration_seconds_count %d\n", count)
+
+	metric("xkcd_queue_depth", "gauge", "Items waiting in the worker pool channels.")
+	fmt.Fprintf(w, "xkcd_queue_depth{queue=\"jobs\"} %d\n", len(m.jobs))
+	fmt.Fprintf(w, "xkcd_queue_depth{queue=\"results\"} %d\n", len(m.results))
+	m.mu.Unlock()
+
+	concurrency.mu.Lock()
+	limit := concurrency.limit
+	concurrency.mu.Unlock()
+	metric("xkcd_concurrency_limit", "gauge", "Requests allowed in flight.")
+	fmt.Fprintf(w, "xkcd_concurrency_limit %d\n", limit)
+}
+
+// serveMetrics serves /metrics on addr until the returned function is called.
+func serveMetrics(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
+
+func (m *crawlMetrics) progressLine() string {
+	done, failed, total := m.fetched.Load(), m.failed.Load(), m.total.Load()
+	m.mu.Lock()
+	elapsed := time.Since(m.start)
+	m.mu.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d/%d", done+failed, total)
+	if total > 0 {
+		fmt.Fprintf(&sb, "  %d%%", (done+failed)*100/total)
+	}
+	if rate := float64(done+failed) / elapsed.Seconds(); rate > 0 {
+		eta := time.Duration(float64(total-done-failed) / rate * float64(time.Second))
+		fmt.Fprintf(&sb, "  %.1f/s  ETA %v", rate, eta.Round(time.Second))
+	}
+	fmt.Fprintf(&sb, "  %d errors", failed)
+	return sb.String()
+}
+
+// startProgress redraws the progress line on stderr until the returned function is called.
+func startProgress() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				fmt.Fprintf(os.Stderr, "\r\033[K%s\n", metrics.progressLine())
+				return
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "\r\033[K%s", metrics.progressLine())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
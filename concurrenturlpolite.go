@@ -0,0 +1,350 @@
+/*
+Politeness controls for the crawler.
+
+A hundred workers without any throttling hammer xkcd.com as fast as the network allows, which is rude to the site and gets a shared CI egress address blocked. Every request of the crawler therefore goes through politeDo, which applies:
+
+	-rate, -burst     a token bucket: on average -rate requests per second, with short bursts of up to -burst
+	-per-host         at most this many requests in flight to the same host, however many workers there are
+	-user-agent       identifies the crawler to the site operator
+	-robots           checks the host's robots.txt and refuses paths it disallows for our User-Agent
+
+The token bucket holds up to burst tokens and refills at rate tokens per second. Each request takes one token, and when the bucket is empty the request waits until the next token arrives.
+
+At the end of the run the settings and what they cost (requests, time spent waiting, robots.txt refusals) are printed with the summary.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUserAgent = "xkcd-indexer/1.0"
+
+type tokenBucket struct {
+	rate  float64 // tokens per second, 0 means unlimited
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+/*
+reserve takes a token and returns how long the caller has to wait before using it. The balance may go negative: later callers then queue up behind the ones already waiting.
+*/
+
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	if b.rate <= 0 {
+		return 0, nil
+	}
+
+	d := b.reserve()
+	if d == 0 {
+		return 0, nil
+	}
+	select {
+	case <-time.After(d):
+		return d, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// errDisallowed is returned for URLs that robots.txt does not let us fetch.
+var errDisallowed = errors.New("disallowed by robots.txt")
+
+type politeness struct {
+	limiter   *tokenBucket
+	perHost   int
+	userAgent string
+	robots    bool
+
+	mu       sync.Mutex
+	slots    map[string]chan struct{}
+	robotTxt map[string]*robotsEntry
+
+	requests atomic.Int64
+	waited   atomic.Int64 // nanoseconds spent waiting for the limiter
+	blocked  atomic.Int64
+}
+
+// polite is shared by every request of the run, main configures it from the flags
+var polite = newPoliteness(10, 10, 10, defaultUserAgent, true)
+
+func newPoliteness(rate float64, burst, perHost int, userAgent string, robots bool) *politeness {
+	return &politeness{
+		limiter:   newTokenBucket(rate, burst),
+		perHost:   perHost,
+		userAgent: userAgent,
+		robots:    robots,
+		slots:     make(map[string]chan struct{}),
+		robotTxt:  make(map[string]*robotsEntry),
+	}
+}
+
+func (p *politeness) slot(host string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.slots[host]
+	if !ok {
+		s = make(chan struct{}, max(p.perHost, 1))
+		p.slots[host] = s
+	}
+	return s
+}
+
+// releaseBody gives the host slot back once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+/*
+politeDo sends req with client once robots.txt, the rate limiter, the per-host limit and the adaptive concurrency limit allow it. The host slot is held until the caller closes the response body, so reading a large body still counts as a request in flight.
+*/
+
+func politeDo(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	p := polite
+	req.Header.Set("User-Agent", p.userAgent)
+
+	if p.robots {
+		rules, err := p.robotsFor(ctx, client, req.URL)
+		if err != nil {
+			return nil, err
+		}
+		if !rules.allowed(req.URL.EscapedPath()) {
+			p.blocked.Add(1)
+			return nil, fmt.Errorf("%s: %w", req.URL, errDisallowed)
+		}
+	}
+
+	waited, err := p.limiter.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.waited.Add(int64(waited))
+
+	slot := p.slot(req.URL.Host)
+	select {
+	case slot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-slot }
+
+	// the adaptive limit only sees the request itself, not the time spent waiting above (see concurrenturladaptive.go)
+	if err := concurrency.acquire(ctx); err != nil {
+		release()
+		return nil, err
+	}
+
+	p.requests.Add(1)
+	start := time.Now()
+	resp, err := client.Do(req)
+
+	observed := err
+	if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		observed = &statusError{Code: resp.StatusCode}
+	}
+	concurrency.release(time.Since(start), observed)
+
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (p *politeness) summary() string {
+	rate := "unlimited"
+	if p.limiter.rate > 0 {
+		rate = fmt.Sprintf("%g/s burst %g", p.limiter.rate, p.limiter.burst)
+	}
+	return fmt.Sprintf("politeness: rate %s, %d per host, user-agent %q; %d requests, %v total wait for the rate limit, %d blocked by robots.txt",
+		rate, p.perHost, p.userAgent, p.requests.Load(), time.Duration(p.waited.Load()).Round(time.Millisecond), p.blocked.Load())
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern *regexp.Regexp
+	length  int
+}
+
+type robotsRules struct {
+	rules []robotsRule
+}
+
+/*
+allowed applies the usual robots.txt precedence: the most specific (longest) matching rule wins, and Allow wins a tie. No matching rule means allowed.
+*/
+
+func (r *robotsRules) allowed(path string) bool {
+	best, allow := -1, true
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > best || (rule.length == best && rule.allow) {
+			best, allow = rule.length, rule.allow
+		}
+	}
+	return allow
+}
+
+type robotsEntry struct {
+	mu    sync.Mutex
+	rules *robotsRules
+}
+
+/*
+robotsFor fetches and parses robots.txt once per host. The workers that start at the same time wait for the first one instead of all fetching it; a failed fetch is not cached, so the next request tries again. A missing robots.txt allows everything, a server error is retried like any other transient error.
+*/
+
+func (p *politeness) robotsFor(ctx context.Context, client *http.Client, u *url.URL) (*robotsRules, error) {
+	p.mu.Lock()
+	e, ok := p.robotTxt[u.Host]
+	if !ok {
+		e = &robotsEntry{}
+		p.robotTxt[u.Host] = e
+	}
+	p.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rules != nil {
+		return e.rules, nil
+	}
+
+	robotsURL := u.Scheme + "://" + u.Host + "/robots.txt"
+	req, err := http.NewRequestWithContext(ctx, "GET", robotsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request: %w", err)
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http err: robots.txt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		e.rules = parseRobots(io.LimitReader(resp.Body, 512<<10), p.userAgent)
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("robots.txt: %w", &statusError{Code: resp.StatusCode})
+	default:
+		e.rules = &robotsRules{}
+	}
+	return e.rules, nil
+}
+
+/*
+parseRobots keeps the rules of the group that names our User-Agent, or of the "*" group when no group does. The product name before the slash ("xkcd-indexer") is what a group has to name, compared whole and ignoring case.
+*/
+
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	product := strings.ToLower(strings.TrimSpace(strings.SplitN(userAgent, "/", 2)[0]))
+
+	var own, any []robotsRule
+	var agents []string
+	inRules := false
+	foundOwn := false
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// a user-agent line after rules starts a new group
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			// a group naming us counts even when it allows everything
+			if agent == product {
+				foundOwn = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", pattern: robotsPattern(value), length: len(value)}
+			for _, a := range agents {
+				switch {
+				case a == "*":
+					any = append(any, rule)
+				case a == product:
+					own = append(own, rule)
+				}
+			}
+		}
+	}
+
+	if foundOwn {
+		return &robotsRules{rules: own}
+	}
+	return &robotsRules{rules: any}
+}
+
+// robotsPattern turns a robots.txt path with * and $ wildcards into a prefix regexp.
+func robotsPattern(path string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(path)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	if strings.HasSuffix(expr, `\$`) {
+		expr = strings.TrimSuffix(expr, `\$`) + "$"
+	}
+	return regexp.MustCompile("^" + expr)
+}
@@ -0,0 +1,133 @@
+/*
+Recording and replaying HTTP traffic.
+
+Every request of the crawler goes through the transport below, which talks to the network directly unless one of the flags replaces it:
+
+	-record dir    requests go to the network as usual, and every request/response pair is also saved into dir
+	-replay dir    nothing goes to the network, responses are served from the fixtures in dir
+
+	go run concurrenturl*.go -record fixtures -to 50
+	go run concurrenturl*.go -replay fixtures -to 50
+
+A fixture is one JSON file per request, named by the SHA-256 of the method and URL, holding the status, headers and body of the response. Replaying the same crawl therefore gives the same result on an air-gapped machine, and makes the worker pool, error paths and JSON decoding testable without hitting the real site. concurrenturlreplay_test.go drives the worker pool and the retries that way:
+
+	go test concurrenturl*.go
+
+A request without a fixture fails with an error instead of going to the network. The rate limit is switched off while replaying, as there is no server to be polite to.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// transport is the RoundTripper of httpClient (see concurrenturlclient.go), the flags wrap it in recording, replaying and caching
+var transport http.RoundTripper = newBaseTransport(defaultClientConfig)
+
+type fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// text bodies are kept readable, anything else (images) is stored base64 encoded
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+}
+
+func newFixture(req *http.Request, resp *http.Response, body []byte) fixture {
+	f := fixture{Method: req.Method, URL: req.URL.String(), Status: resp.StatusCode, Header: resp.Header}
+	if utf8.Valid(body) {
+		f.Body = string(body)
+	} else {
+		f.BodyBase64 = body
+	}
+	return f
+}
+
+func (f *fixture) body() []byte {
+	if f.BodyBase64 != nil {
+		return f.BodyBase64
+	}
+	return []byte(f.Body)
+}
+
+func fixturePath(dir string, req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func newRecordingTransport(next http.RoundTripper, dir string) (*recordingTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recordingTransport{next: next, dir: dir}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// the caller still gets to read the body
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	data, err := json.MarshalIndent(newFixture(req, resp, body), "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("json err: %v", err)
+	}
+	if err := writeFileAtomic(fixturePath(t.dir, req), data); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	return resp, nil
+}
+
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	data, err := os.ReadFile(fixturePath(t.dir, req))
+	if err != nil {
+		return nil, fmt.Errorf("replay: no fixture for %s %s", req.Method, req.URL)
+	}
+
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("replay: json err: %v", err)
+	}
+
+	body := f.body()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        f.Header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
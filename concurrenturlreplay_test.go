@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBaseURL = "http://xkcd.test"
+
+// fastRetry keeps the retry tests from waiting for the real backoff
+var fastRetry = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetryAfter: time.Millisecond}
+
+func comicJSON(n int) string {
+	return fmt.Sprintf(`{"num":%d,"title":"Comic %d","safe_title":"Comic %d","img":"https://imgs.xkcd.com/comics/%d.png","year":"2010","month":"1","day":"2","transcript":"[[Scene %d]]\nCueball: Hello."}`, n, n, n, n, n)
+}
+
+// writeFixture saves the response a replay of GET url returns.
+func writeFixture(t *testing.T, dir, url string, status int, body string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := fixture{Method: "GET", URL: url, Status: status, Header: http.Header{"Content-Type": {"application/json"}}, Body: body}
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fixturePath(dir, req), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fixtureURL(n int) string {
+	return fmt.Sprintf("%s/%d/info.0.json", testBaseURL, n)
+}
+
+// flakyTransport answers the first failures requests of every URL with 503 before passing them on.
+type flakyTransport struct {
+	next     http.RoundTripper
+	failures int
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.calls[req.URL.String()]++
+	n := t.calls[req.URL.String()]
+	t.mu.Unlock()
+
+	if n <= t.failures {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// eofTransport is a server that closes every connection before it answers.
+type eofTransport struct{}
+
+func (eofTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, io.EOF
+}
+
+// useReplay points the crawler at the fixtures in dir, through rt if it is not nil, and restores everything afterwards.
+func useReplay(t *testing.T, dir string, rt http.RoundTripper) {
+	t.Helper()
+	oldSource, oldClient, oldTransport, oldPolite, oldConcurrency, oldConsole := source, httpClient, transport, polite, concurrency, console
+	oldIndex := indexFile
+	t.Cleanup(func() {
+		source, httpClient, transport, polite, concurrency, console = oldSource, oldClient, oldTransport, oldPolite, oldConcurrency, oldConsole
+		indexFile = oldIndex
+		resultCollection = nil
+		failures = failureLog{}
+	})
+
+	if rt == nil {
+		rt = &replayTransport{dir: dir}
+	}
+	source = newXkcdSource(testBaseURL)
+	httpClient = &http.Client{Transport: rt}
+	polite = newPoliteness(0, 10, 10, defaultUserAgent, false)
+	concurrency = newAdaptiveLimit(4, 4)
+	console = io.Discard
+	resultCollection = nil
+	failures = failureLog{}
+
+	// runPool saves the failure manifest next to the index, xkcd.json in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, fixtureURL(1), http.StatusOK, comicJSON(1))
+	writeFixture(t, dir, fixtureURL(404), http.StatusNotFound, "")
+	writeFixture(t, dir, fixtureURL(2), http.StatusOK, `{"num": 2, "title": `)
+	writeFixture(t, dir, fixtureURL(3), http.StatusServiceUnavailable, "")
+
+	flaky := &flakyTransport{next: &replayTransport{dir: dir}, calls: make(map[string]int)}
+	useReplay(t, dir, flaky)
+	ctx := context.Background()
+
+	t.Run("ok", func(t *testing.T) {
+		r, err := fetchWithRetry(ctx, 1, fastRetry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Num != 1 || r.Title != "Comic 1" || len(r.Script) == 0 {
+			t.Errorf("decoded %+v", r)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		num      int
+		class    errorClass
+		attempts int
+	}{
+		{"404 is missing", 404, classMissing, 1},
+		{"bad JSON is permanent", 2, classPermanent, 1},
+		{"5xx is retried", 3, classTransient, fastRetry.MaxAttempts},
+		{"no fixture is permanent", 5, classPermanent, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fetchWithRetry(ctx, tt.num, fastRetry)
+			var fe *fetchError
+			if !errors.As(err, &fe) {
+				t.Fatalf("got %v, want a fetchError", err)
+			}
+			if fe.Class != tt.class || fe.Attempts != tt.attempts {
+				t.Errorf("got %s after %d attempts, want %s after %d", fe.Class, fe.Attempts, tt.class, tt.attempts)
+			}
+		})
+	}
+
+	t.Run("dropped connection is retried", func(t *testing.T) {
+		oldClient := httpClient
+		defer func() { httpClient = oldClient }()
+		httpClient = &http.Client{Transport: eofTransport{}}
+
+		_, err := fetchWithRetry(ctx, 1, fastRetry)
+		var fe *fetchError
+		if !errors.As(err, &fe) || fe.Class != classTransient || fe.Attempts != fastRetry.MaxAttempts {
+			t.Errorf("got %v, want transient after %d attempts", err, fastRetry.MaxAttempts)
+		}
+	})
+
+	t.Run("5xx then ok", func(t *testing.T) {
+		flaky.failures = fastRetry.MaxAttempts - 1
+		flaky.calls = make(map[string]int)
+		r, err := fetchWithRetry(ctx, 1, fastRetry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Num != 1 {
+			t.Errorf("got #%d", r.Num)
+		}
+	})
+}
+
+func TestRunPool(t *testing.T) {
+	dir := t.TempDir()
+	for n := 1; n <= 20; n++ {
+		switch n {
+		case 4:
+			writeFixture(t, dir, fixtureURL(n), http.StatusNotFound, "")
+		case 7:
+			writeFixture(t, dir, fixtureURL(n), http.StatusOK, "not json")
+		default:
+			writeFixture(t, dir, fixtureURL(n), http.StatusOK, comicJSON(n))
+		}
+	}
+	useReplay(t, dir, nil)
+
+	numbers := make([]int, 20)
+	for i := range numbers {
+		numbers[i] = i + 1
+	}
+	runPool(context.Background(), numbers, 4)
+
+	got := make(map[int]bool)
+	for _, r := range resultCollection {
+		if got[r.Num] {
+			t.Errorf("#%d collected twice", r.Num)
+		}
+		got[r.Num] = true
+	}
+	for _, n := range numbers {
+		if want := n != 4 && n != 7; got[n] != want {
+			t.Errorf("#%d collected: %v, want %v", n, got[n], want)
+		}
+	}
+
+	list := failures.list()
+	if len(list) != 2 || list[0].Num != 4 || list[0].Class != classMissing || list[1].Num != 7 || list[1].Class != classPermanent {
+		for _, e := range list {
+			t.Log(e)
+		}
+		t.Fatalf("want #4 missing and #7 permanent, got %d failures", len(list))
+	}
+
+	manifest, err := loadManifest(failuresFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 {
+		t.Errorf("manifest has %d entries, want 2", len(manifest))
+	}
+}
+
+func TestRunPoolCanceled(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, fixtureURL(1), http.StatusOK, comicJSON(1))
+	useReplay(t, dir, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runPool(ctx, []int{1, 2, 3}, 2)
+
+	if len(resultCollection) != 0 || len(failures.list()) != 0 {
+		t.Errorf("a canceled pool collected %d results and %d failures", len(resultCollection), len(failures.list()))
+	}
+}
+
+func TestCrawlKeepsIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []int{3, 4} {
+		writeFixture(t, dir, fixtureURL(n), http.StatusOK, strings.Replace(comicJSON(n), `"title":"Comic`, `"title":"New`, 1))
+	}
+	useReplay(t, dir, nil)
+
+	// useReplay changed into a fresh directory
+	var index []Result
+	for n := 1; n <= 12; n++ {
+		var r Result
+		if err := json.Unmarshal([]byte(comicJSON(n)), &r); err != nil {
+			t.Fatal(err)
+		}
+		index = append(index, r)
+	}
+	if err := writeIndex(index); err != nil {
+		t.Fatal(err)
+	}
+
+	crawl := func(from, to string) error {
+		return crawlCommand("crawl", []string{"-replay", dir, "-url", testBaseURL, "-from", from, "-to", to,
+			"-robots=false", "-progress=false", "-cache=", "-workers", "2"})
+	}
+	check := func(newTitles int) {
+		t.Helper()
+		got, err := loadIndex(indexFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 12 {
+			t.Fatalf("index has %d comics after the crawl, want 12", len(got))
+		}
+		updated := 0
+		for i, r := range got {
+			if r.Num != i+1 {
+				t.Fatalf("index[%d] is #%d", i, r.Num)
+			}
+			if strings.HasPrefix(r.Title, "New") {
+				updated++
+			}
+		}
+		if updated != newTitles {
+			t.Errorf("%d comics updated, want %d", updated, newTitles)
+		}
+	}
+
+	if err := crawl("3", "4"); err != nil {
+		t.Fatal(err)
+	}
+	check(2)
+
+	// every fetch fails: the index stays as it was
+	resultCollection = nil
+	if err := crawl("20", "21"); !errors.Is(err, errIncomplete) {
+		t.Fatalf("got %v, want an incomplete crawl", err)
+	}
+	check(2)
+}
@@ -0,0 +1,252 @@
+/*
+Retrying failed fetches.
+
+A single attempt per comic is fragile when 3000 requests go out in a few minutes: a timeout, a reset connection or a 503 from an overloaded server would lose that comic for the whole run. Not every failure is worth retrying though, so each error is put in one of three classes:
+
+	transient   timeouts, connection resets, 429 Too Many Requests and 5xx responses: retried
+	missing     404 Not Found: the comic does not exist, recorded but never retried
+	permanent   anything else (other 4xx, broken JSON): recorded, retrying would not help
+
+Transient errors are retried with capped exponential backoff: the delay doubles on every attempt up to MaxDelay, and a random jitter spreads the retries of 100 workers so they do not all hit the server at the same moment. If the server sends a Retry-After header we wait that long instead.
+
+Every number that still fails is added to the failure log, which is printed at the end of the run so nothing is dropped silently.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type errorClass string
+
+const (
+	classTransient errorClass = "transient"
+	classMissing   errorClass = "missing"
+	classPermanent errorClass = "permanent"
+)
+
+// statusError is returned by fetch for any response other than 200 OK.
+type statusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("http status: %d %s", e.Code, http.StatusText(e.Code))
+}
+
+func classify(err error) errorClass {
+	var se *statusError
+	if errors.As(err, &se) {
+		switch {
+		case se.Code == http.StatusNotFound:
+			return classMissing
+		case se.Code == http.StatusTooManyRequests, se.Code >= 500:
+			return classTransient
+		}
+		return classPermanent
+	}
+
+	// a canceled crawl is not retried
+	if errors.Is(err, context.Canceled) {
+		return classPermanent
+	}
+
+	// a server that closes the connection before answering; only for errors of client.Do, an EOF while decoding is not retried
+	var ue *url.Error
+	if errors.As(err, &ue) && errors.Is(ue.Err, io.EOF) {
+		return classTransient
+	}
+
+	// network level problems: timeouts, resets, refused or dropped connections. Every client.Do error is a
+	// net.Error, bad certificates and missing fixtures included, so only its timeouts count.
+	var ne net.Error
+	if (errors.As(err, &ne) && ne.Timeout()) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return classTransient
+	}
+	return classPermanent
+}
+
+// parseRetryAfter understands both forms of the header: delay-seconds and an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// upper bound for a server supplied Retry-After, so one response cannot stall a worker forever
+	MaxRetryAfter time.Duration
+}
+
+var defaultRetry = retryPolicy{
+	MaxAttempts:   5,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      30 * time.Second,
+	MaxRetryAfter: 2 * time.Minute,
+}
+
+/*
+backoff returns how long to wait before the given retry (1 for the first retry). The exponential delay is capped at MaxDelay and then "equal jitter" is applied: a random duration between half the delay and the full delay.
+*/
+
+func (p retryPolicy) backoff(retry int, err error) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		return min(se.RetryAfter, p.MaxRetryAfter)
+	}
+
+	d := p.BaseDelay << (retry - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// fetchError is what is left of a comic that could not be fetched.
+type fetchError struct {
+	Num      int
+	Status   int // HTTP status of the last attempt, 0 when there was no response
+	Class    errorClass
+	Attempts int
+	Time     time.Time
+	Err      error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("#%d: %s after %d attempt(s): %v", e.Num, e.Class, e.Attempts, e.Err)
+}
+
+func (e *fetchError) Unwrap() error { return e.Err }
+
+func fetchWithRetry(ctx context.Context, n int, p retryPolicy) (*Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := fetch(ctx, n)
+		if err == nil {
+			return result, nil
+		}
+
+		class := classify(err)
+		if class != classTransient || attempt >= p.MaxAttempts {
+			fe := &fetchError{Num: n, Class: class, Attempts: attempt, Time: time.Now(), Err: err}
+			var se *statusError
+			if errors.As(err, &se) {
+				fe.Status = se.Code
+			}
+			return nil, fe
+		}
+
+		delay := p.backoff(attempt, err)
+		metrics.retries.Add(1)
+		log.Printf("retrying #%d in %v (attempt %d): %v\n", n, delay.Round(time.Millisecond), attempt, err)
+
+		// a canceled crawl does not wait for the backoff to run out
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+failureLog collects the comics that could not be fetched. Workers add to it concurrently, so access is guarded by a mutex.
+*/
+
+type failureLog struct {
+	mu       sync.Mutex
+	failures []*fetchError
+	fetched  map[int]bool // numbers that succeeded in this run
+	reported int          // failures already printed by report
+}
+
+var failures failureLog
+
+func (f *failureLog) add(err *fetchError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, err)
+}
+
+func (f *failureLog) succeeded(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fetched == nil {
+		f.fetched = make(map[int]bool)
+	}
+	f.fetched[n] = true
+}
+
+func (f *failureLog) list() []*fetchError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := append([]*fetchError(nil), f.failures...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Num < list[j].Num })
+	return list
+}
+
+// report prints the numbers that failed since the last report and why, missing comics first, to the console (see concurrenturlsink.go).
+// A sharded crawl runs the pool once per chunk and so only sees each chunk's failures once.
+func (f *failureLog) report() {
+	f.mu.Lock()
+	list := append([]*fetchError(nil), f.failures[f.reported:]...)
+	f.reported = len(f.failures)
+	f.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Num < list[j].Num })
+	if len(list) == 0 {
+		return
+	}
+
+	var missing []int
+	failed := 0
+	for _, e := range list {
+		if e.Class == classMissing {
+			missing = append(missing, e.Num)
+			continue
+		}
+		failed++
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(console, "%d missing (404): %v\n", len(missing), missing)
+	}
+	if failed > 0 {
+		fmt.Fprintf(console, "%d failed:\n", failed)
+		for _, e := range list {
+			if e.Class != classMissing {
+				fmt.Fprintf(console, "  %v\n", e)
+			}
+		}
+	}
+}
@@ -0,0 +1,326 @@
+/*
+Full-text search over the offline index.
+
+	go run concurrenturl*.go search bobby tables
+	go run concurrenturl*.go search -n 5 '"little bobby tables" sql'
+
+The Title, SafeTitle, Alt and Transcript of every comic are split into lower-cased tokens and put into an inverted index: for every token, the list of comics it appears in and at which positions. Positions make phrase queries possible, a phrase in double quotes only matches comics where its words appear next to each other.
+
+Results are ranked with BM25, the usual refinement of TF-IDF: a token counts more the rarer it is across the index (inverse document frequency), repeating it in one comic helps less and less (term frequency saturation), and long transcripts do not win just because they are long (length normalization).
+
+Building the index takes a moment, so it is saved to xkcd.index.json next to xkcd.json and only rebuilt when xkcd.json is newer.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchIndexFile is next to the index it was built from: xkcd.json has xkcd.index.json
+func searchIndexFile() string {
+	return strings.TrimSuffix(indexFile, filepath.Ext(indexFile)) + ".index.json"
+}
+
+// BM25 tuning, these are the commonly used defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type posting struct {
+	Doc       int   `json:"d"`
+	Positions []int `json:"p"`
+}
+
+type searchDoc struct {
+	Num    int `json:"num"`
+	Length int `json:"len"`
+}
+
+type searchIndex struct {
+	Docs      []searchDoc          `json:"docs"`
+	AvgLength float64              `json:"avg_len"`
+	Postings  map[string][]posting `json:"postings"`
+}
+
+// tokenize splits text into lower-cased words made of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchFields are the parts of a comic that are indexed, in the order they are searched for snippets.
+func searchFields(r Result) []string {
+	return []string{r.Title, r.SafeTitle, r.Alt, r.Transcript}
+}
+
+func buildSearchIndex(index []Result) *searchIndex {
+	si := &searchIndex{Postings: make(map[string][]posting)}
+
+	total := 0
+	for doc, r := range index {
+		positions := make(map[string][]int)
+		pos := 0
+		for _, field := range searchFields(r) {
+			for _, tok := range tokenize(field) {
+				positions[tok] = append(positions[tok], pos)
+				pos++
+			}
+			// leave a gap so a phrase cannot match across two fields
+			pos++
+		}
+
+		for tok, p := range positions {
+			si.Postings[tok] = append(si.Postings[tok], posting{Doc: doc, Positions: p})
+		}
+		si.Docs = append(si.Docs, searchDoc{Num: r.Num, Length: pos})
+		total += pos
+	}
+
+	if len(si.Docs) > 0 {
+		si.AvgLength = float64(total) / float64(len(si.Docs))
+	}
+	return si
+}
+
+/*
+loadSearchIndex returns the persisted index, rebuilding it from xkcd.json when the saved one is missing or older than the index it was built from.
+*/
+
+func loadSearchIndex(index []Result) (*searchIndex, error) {
+	src, err := os.Stat(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if st, err := os.Stat(searchIndexFile()); err == nil && !st.ModTime().Before(src.ModTime()) {
+		data, err := os.ReadFile(searchIndexFile())
+		if err != nil {
+			return nil, err
+		}
+		var si searchIndex
+		if err := json.Unmarshal(data, &si); err == nil && len(si.Docs) == len(index) {
+			return &si, nil
+		}
+	}
+
+	si := buildSearchIndex(index)
+	data, err := json.Marshal(si)
+	if err != nil {
+		return nil, fmt.Errorf("json err: %v", err)
+	}
+	if err := os.WriteFile(searchIndexFile(), data, 0644); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+type query struct {
+	terms   []string
+	phrases [][]string
+}
+
+// parseQuery splits the query into loose terms and "quoted phrases".
+func parseQuery(q string) query {
+	var parsed query
+	parts := strings.Split(q, `"`)
+	for i, part := range parts {
+		toks := tokenize(part)
+		// odd parts are inside quotes
+		if i%2 == 1 && len(toks) > 1 {
+			parsed.phrases = append(parsed.phrases, toks)
+		}
+		parsed.terms = append(parsed.terms, toks...)
+	}
+	return parsed
+}
+
+type hit struct {
+	Doc   int
+	Score float64
+}
+
+func (si *searchIndex) postingFor(tok string, doc int) *posting {
+	list := si.Postings[tok]
+	i := sort.Search(len(list), func(i int) bool { return list[i].Doc >= doc })
+	if i < len(list) && list[i].Doc == doc {
+		return &list[i]
+	}
+	return nil
+}
+
+// hasPhrase reports whether the words of phrase follow each other somewhere in doc.
+func (si *searchIndex) hasPhrase(doc int, phrase []string) bool {
+	first := si.postingFor(phrase[0], doc)
+	if first == nil {
+		return false
+	}
+
+	for _, start := range first.Positions {
+		found := true
+		for i, tok := range phrase[1:] {
+			p := si.postingFor(tok, doc)
+			if p == nil {
+				return false
+			}
+			j := sort.SearchInts(p.Positions, start+i+1)
+			if j == len(p.Positions) || p.Positions[j] != start+i+1 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (si *searchIndex) search(q query) []hit {
+	n := float64(len(si.Docs))
+	scores := make(map[int]float64)
+
+	for _, tok := range q.terms {
+		list := si.Postings[tok]
+		df := float64(len(list))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		for _, p := range list {
+			tf := float64(len(p.Positions))
+			norm := 1 - bm25B + bm25B*float64(si.Docs[p.Doc].Length)/si.AvgLength
+			scores[p.Doc] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	var hits []hit
+	for doc, score := range scores {
+		matches := true
+		for _, phrase := range q.phrases {
+			if !si.hasPhrase(doc, phrase) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			hits = append(hits, hit{doc, score})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return si.Docs[hits[i].Doc].Num < si.Docs[hits[j].Doc].Num
+	})
+	return hits
+}
+
+/*
+snippet picks the first field of r that contains a query term and returns a few words around the first match, with every matching word highlighted.
+*/
+
+func snippet(r Result, terms []string, highlight func(string) string) string {
+	const radius = 8
+
+	want := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		want[t] = true
+	}
+
+	for _, field := range searchFields(r)[2:] {
+		words := strings.Fields(field)
+		for i, w := range words {
+			if !matchesAny(w, want) {
+				continue
+			}
+
+			from, to := max(i-radius, 0), min(i+radius+1, len(words))
+			out := make([]string, 0, to-from)
+			for _, w := range words[from:to] {
+				if matchesAny(w, want) {
+					w = highlight(w)
+				}
+				out = append(out, w)
+			}
+
+			s := strings.Join(out, " ")
+			if from > 0 {
+				s = "..." + s
+			}
+			if to < len(words) {
+				s += "..."
+			}
+			return s
+		}
+	}
+	return r.Alt
+}
+
+func matchesAny(word string, want map[string]bool) bool {
+	for _, tok := range tokenize(word) {
+		if want[tok] {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+func searchCommand(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	addIndexFlag(fs)
+	limit := fs.Int("n", 10, "number of results to show")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *limit < 1 {
+		return usagef("-n must be at least 1, got %d", *limit)
+	}
+
+	q := parseQuery(strings.Join(fs.Args(), " "))
+	if len(q.terms) == 0 {
+		return usagef("no query given")
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	si, err := loadSearchIndex(index)
+	if err != nil {
+		return err
+	}
+
+	// bold on a terminal, plain markers when the output is piped somewhere
+	highlight := func(s string) string { return "[" + s + "]" }
+	if isTerminal(os.Stdout) {
+		highlight = func(s string) string { return "\033[1m" + s + "\033[0m" }
+	}
+
+	hits := si.search(q)
+	if len(hits) == 0 {
+		fmt.Println("no results")
+		return nil
+	}
+	for _, h := range hits[:min(*limit, len(hits))] {
+		r := index[h.Doc]
+		fmt.Printf("#%-5d %s\n       %s\n", r.Num, r.Title, snippet(r, q.terms, highlight))
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+/*
+Serving the offline index as a local JSON API.
+
+Other tools should not each have to parse xkcd.json themselves, so the serve mode loads it once and answers over HTTP:
+
+	go run concurrenturl*.go serve -addr localhost:8080
+
+	GET /comics/{num}              one comic
+	GET /comics?year=&month=       comics, optionally filtered, paginated with page and per_page
+	GET /comics/latest             the comic with the highest number
+	GET /comics/random             a random comic
+	GET /search?q=                 full-text search (see concurrenturlsearch.go), paginated
+
+Every response is JSON, including errors ({"error": "..."} with 400 or 404). Responses carry an ETag computed from the body, so a client sending If-None-Match gets 304 Not Modified when nothing changed; /comics/random is the exception and is never cached.
+
+The server checks the modification time of xkcd.json every few seconds and reloads it when it changes, so a nightly sync is picked up without a restart. If the new file cannot be read, the old index keeps being served.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	reloadInterval = 2 * time.Second
+	maxPerPage     = 500
+)
+
+type indexServer struct {
+	path    string
+	perPage int
+
+	mu      sync.RWMutex
+	comics  []Result // in file order, the search index refers to these positions
+	sorted  []*Result
+	byNum   map[int]*Result
+	search  *searchIndex
+	modTime time.Time
+}
+
+// load reads the index and swaps it in, the old one stays in place on error.
+func (s *indexServer) load() error {
+	st, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	comics, err := loadIndex(s.path)
+	if err != nil {
+		return err
+	}
+
+	byNum := make(map[int]*Result, len(comics))
+	sorted := make([]*Result, 0, len(comics))
+	for i := range comics {
+		byNum[comics[i].Num] = &comics[i]
+		sorted = append(sorted, &comics[i])
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Num < sorted[j].Num })
+
+	s.mu.Lock()
+	s.comics, s.sorted, s.byNum = comics, sorted, byNum
+	s.search = buildSearchIndex(comics)
+	s.modTime = st.ModTime()
+	s.mu.Unlock()
+
+	log.Printf("loaded %d comics from %s\n", len(comics), s.path)
+	return nil
+}
+
+// watch reloads the index whenever the file on disk gets a new modification time.
+func (s *indexServer) watch(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st, err := os.Stat(s.path)
+		if err != nil {
+			continue
+		}
+		s.mu.RLock()
+		changed := !st.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+
+		if changed {
+			if err := s.load(); err != nil {
+				log.Printf("error in reloading %s: %v\n", s.path, err)
+			}
+		}
+	}
+}
+
+func (s *indexServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /comics", s.listComics)
+	mux.HandleFunc("GET /comics/latest", s.latestComic)
+	mux.HandleFunc("GET /comics/random", s.randomComic)
+	mux.HandleFunc("GET /comics/{num}", s.getComic)
+	mux.HandleFunc("GET /search", s.searchComics)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+	return mux
+}
+
+type page struct {
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+	Items   interface{} `json:"items"`
+}
+
+// pagination reads page and per_page, both starting from sensible defaults.
+func (s *indexServer) pagination(r *http.Request) (pageNo, perPage int, err error) {
+	pageNo, perPage = 1, s.perPage
+	if v := r.URL.Query().Get("page"); v != "" {
+		if pageNo, err = strconv.Atoi(v); err != nil || pageNo < 1 {
+			return 0, 0, errors.New("page must be a positive number")
+		}
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, errors.New("per_page must be between 1 and " + strconv.Itoa(maxPerPage))
+		}
+	}
+	return pageNo, perPage, nil
+}
+
+// dateFilter reads year and month as numbers, 0 when not given, so month=01 and month=1 agree.
+// They are compared with the parsed date (see concurrenturldates.go).
+func dateFilter(r *http.Request) (year, month int, err error) {
+	if v := r.URL.Query().Get("year"); v != "" {
+		if year, err = strconv.Atoi(v); err != nil || year < 1 {
+			return 0, 0, errors.New("year must be a positive number")
+		}
+	}
+	if v := r.URL.Query().Get("month"); v != "" {
+		if month, err = strconv.Atoi(v); err != nil || month < 1 || month > 12 {
+			return 0, 0, errors.New("month must be a number between 1 and 12")
+		}
+	}
+	return year, month, nil
+}
+
+func paginate[T any](items []T, pageNo, perPage int) page {
+	from := min((pageNo-1)*perPage, len(items))
+	to := min(from+perPage, len(items))
+	// copied so an empty page is [] instead of null
+	return page{Page: pageNo, PerPage: perPage, Total: len(items), Items: append([]T{}, items[from:to]...)}
+}
+
+func (s *indexServer) listComics(w http.ResponseWriter, r *http.Request) {
+	pageNo, perPage, err := s.pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	year, month, err := dateFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	var list []*Result
+	for _, c := range s.sorted {
+		if (year == 0 || c.Published.Year() == year) && (month == 0 || int(c.Published.Month()) == month) {
+			list = append(list, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	writeJSON(w, r, paginate(list, pageNo, perPage))
+}
+
+func (s *indexServer) getComic(w http.ResponseWriter, r *http.Request) {
+	num, err := strconv.Atoi(r.PathValue("num"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "comic number must be a number")
+		return
+	}
+
+	s.mu.RLock()
+	c, ok := s.byNum[num]
+	s.mu.RUnlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "comic not found")
+		return
+	}
+	writeJSON(w, r, c)
+}
+
+func (s *indexServer) latestComic(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.sorted) == 0 {
+		writeError(w, http.StatusNotFound, "index is empty")
+		return
+	}
+	writeJSON(w, r, s.sorted[len(s.sorted)-1])
+}
+
+func (s *indexServer) randomComic(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.sorted) == 0 {
+		writeError(w, http.StatusNotFound, "index is empty")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, nil, s.sorted[rand.Intn(len(s.sorted))])
+}
+
+type searchHit struct {
+	Num   int     `json:"num"`
+	Title string  `json:"title"`
+	Score float64 `json:"score"`
+}
+
+func (s *indexServer) searchComics(w http.ResponseWriter, r *http.Request) {
+	q := parseQuery(r.URL.Query().Get("q"))
+	if len(q.terms) == 0 {
+		writeError(w, http.StatusBadRequest, "missing query parameter q")
+		return
+	}
+	pageNo, perPage, err := s.pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	var list []searchHit
+	for _, h := range s.search.search(q) {
+		c := s.comics[h.Doc]
+		list = append(list, searchHit{Num: c.Num, Title: c.Title, Score: h.Score})
+	}
+	s.mu.RUnlock()
+
+	writeJSON(w, r, paginate(list, pageNo, perPage))
+}
+
+/*
+writeJSON sends v with an ETag derived from the encoded body. When the request already has that ETag in If-None-Match, only 304 Not Modified is sent. A nil request skips the ETag.
+*/
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "json err: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r != nil {
+		sum := sha256.Sum256(data)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addIndexFlag(fs)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	perPage := fs.Int("per-page", 50, "default page size")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *perPage < 1 {
+		return usagef("-per-page must be at least 1, got %d", *perPage)
+	}
+
+	s := &indexServer{path: indexFile, perPage: min(*perPage, maxPerPage)}
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	ctx, stop := crawlContext(0)
+	defer stop()
+	go s.watch(ctx)
+
+	srv := &http.Server{Addr: *addr, Handler: s.routes()}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	log.Printf("serving %s on http://%s\n", s.path, *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+/*
+Sharded crawling.
+
+A large range can be split across several processes, on one machine or on several that share a directory. Every process is started the same way:
+
+	go run concurrenturl*.go shard -shards /mnt/shared/crawl -chunk 100 -lease 1m
+
+The first process to arrive writes plan.json into the directory: the range (resolving -to 0 to the newest comic) cut into chunks of -chunk numbers. The others read that plan, so they all agree on the chunks even if their flags differ.
+
+A process claims a chunk by creating its lease file with O_EXCL, which only one process can win:
+
+	chunk-0003.lease.1    owner and expiry of the lease, renewed while the chunk is being fetched
+	chunk-0003.done       written once every comic of the chunk has been fetched and logged
+
+When a process crashes its lease is no longer renewed. Once it has expired, any process takes the chunk over by creating the next generation, chunk-0003.lease.2, again with O_EXCL; the highest generation is the current lease. The owners of the machines must therefore have clocks that roughly agree, within a small part of -lease.
+
+Each process appends its results to its own JSON Lines log in the directory (see concurrenturljsonl.go), so nothing is shared while crawling. A chunk that was taken over may be in two logs; that is harmless, as merging keeps one result per number. When every chunk is done, the process that finishes last merges all logs into its -index. The merge can also be run by hand on any machine that sees the directory:
+
+	go run concurrenturl*.go shard -shards /mnt/shared/crawl -merge
+
+Failed comics are recorded in the failure manifest next to -index as usual (see concurrenturlmanifest.go) and do not keep a chunk from being done.
+
+A directory holds one crawl. Once it is merged, the merge writes a "merged" marker and shard refuses to start in that directory again, rather than finding every chunk done and exiting without fetching anything. A nightly job uses a new directory for every run:
+
+	go run concurrenturl*.go shard -shards /mnt/shared/crawl-$(date +%F)
+
+concurrenturlshard_test.go starts three processes against a local stand-in for the site and checks the merged index, and that an expired lease is taken over.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	shardPlanFile   = "plan.json"
+	shardMergeLock  = "merge.lock"
+	shardMergedFile = "merged"
+)
+
+type shardPlan struct {
+	From  int `json:"from"`
+	To    int `json:"to"`
+	Chunk int `json:"chunk"`
+}
+
+func (p shardPlan) chunks() int {
+	return (p.To - p.From + p.Chunk) / p.Chunk
+}
+
+// bounds is the range of chunk i, both ends included.
+func (p shardPlan) bounds(i int) (lo, hi int) {
+	lo = p.From + i*p.Chunk
+	return lo, min(lo+p.Chunk-1, p.To)
+}
+
+type shardLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+type shardCoordinator struct {
+	dir   string
+	owner string
+	ttl   time.Duration
+	plan  shardPlan
+}
+
+// loadOrCreatePlan reads the plan of dir, or publishes want as the plan if there is none yet.
+func loadOrCreatePlan(dir string, want shardPlan) (shardPlan, error) {
+	path := filepath.Join(dir, shardPlanFile)
+
+	data, err := json.MarshalIndent(want, "", "    ")
+	if err != nil {
+		return shardPlan{}, fmt.Errorf("json err: %v", err)
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return shardPlan{}, err
+	}
+	// a link fails when the plan exists, so only one process gets to publish its plan, and only complete
+	err = os.Link(tmp, path)
+	os.Remove(tmp)
+	if err == nil {
+		return want, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return shardPlan{}, err
+	}
+
+	if data, err = os.ReadFile(path); err != nil {
+		return shardPlan{}, err
+	}
+	var plan shardPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return shardPlan{}, fmt.Errorf("json err: %s: %v", path, err)
+	}
+	if plan != want {
+		log.Printf("using the plan in %s: %d..%d in chunks of %d\n", path, plan.From, plan.To, plan.Chunk)
+	}
+	return plan, nil
+}
+
+func (c *shardCoordinator) leasePath(i, gen int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("chunk-%04d.lease.%d", i, gen))
+}
+
+func (c *shardCoordinator) donePath(i int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("chunk-%04d.done", i))
+}
+
+func (c *shardCoordinator) done(i int) bool {
+	_, err := os.Stat(c.donePath(i))
+	return err == nil
+}
+
+// currentLease returns the highest generation of the lease of chunk i, 0 and nil if it was never claimed.
+func (c *shardCoordinator) currentLease(i int) (int, *shardLease, error) {
+	matches, err := filepath.Glob(filepath.Join(c.dir, fmt.Sprintf("chunk-%04d.lease.*", i)))
+	if err != nil {
+		return 0, nil, err
+	}
+	gen := 0
+	for _, m := range matches {
+		if g, err := strconv.Atoi(m[strings.LastIndexByte(m, '.')+1:]); err == nil && g > gen {
+			gen = g
+		}
+	}
+	if gen == 0 {
+		return 0, nil, nil
+	}
+
+	data, err := os.ReadFile(c.leasePath(i, gen))
+	if err != nil {
+		return 0, nil, err
+	}
+	var l shardLease
+	if err := json.Unmarshal(data, &l); err != nil {
+		// leases are only ever replaced whole, a broken one is treated as expired
+		return gen, &shardLease{}, nil
+	}
+	return gen, &l, nil
+}
+
+func (c *shardCoordinator) writeLease(path string, exclusive bool) error {
+	data, err := json.Marshal(shardLease{Owner: c.owner, Expires: time.Now().Add(c.ttl)})
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	if !exclusive {
+		return writeFileAtomic(path, data)
+	}
+
+	tmp := fmt.Sprintf("%s.%s.tmp", path, c.owner)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Link(tmp, path)
+}
+
+// claim takes chunk i if it is neither done nor held by a live lease, and returns the generation of the new lease.
+func (c *shardCoordinator) claim(i int) (int, bool, error) {
+	if c.done(i) {
+		return 0, false, nil
+	}
+	gen, l, err := c.currentLease(i)
+	if err != nil {
+		return 0, false, err
+	}
+	if l != nil && time.Now().Before(l.Expires) {
+		return 0, false, nil
+	}
+
+	err = c.writeLease(c.leasePath(i, gen+1), true)
+	if errors.Is(err, os.ErrExist) {
+		// another process was faster
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if l != nil {
+		log.Printf("chunk %d: taking over the expired lease of %s\n", i, l.Owner)
+	}
+	return gen + 1, true, nil
+}
+
+// renew keeps the lease of chunk i alive until ctx is done.
+func (c *shardCoordinator) renew(ctx context.Context, i, gen int) {
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current, _, err := c.currentLease(i); err == nil && current != gen {
+				log.Printf("chunk %d: lease was taken over while fetching it\n", i)
+				return
+			}
+			if err := c.writeLease(c.leasePath(i, gen), false); err != nil {
+				log.Printf("chunk %d: renewing the lease: %v\n", i, err)
+			}
+		}
+	}
+}
+
+// release lets the lease of an unfinished chunk expire now, so another process picks it up right away.
+func (c *shardCoordinator) release(i, gen int) {
+	data, _ := json.Marshal(shardLease{Owner: c.owner})
+	writeFileAtomic(c.leasePath(i, gen), data)
+}
+
+func (c *shardCoordinator) allDone() bool {
+	for i := 0; i < c.plan.chunks(); i++ {
+		if !c.done(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// crawlChunk fetches the comics of chunk i into the log of this process.
+func (c *shardCoordinator) crawlChunk(ctx context.Context, i, gen, noOfWorkers int) error {
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	defer stopRenewing()
+	go c.renew(renewCtx, i, gen)
+
+	lo, hi := c.plan.bounds(i)
+	numbers, err := source.IDs(ctx, lo, hi)
+	if err != nil {
+		c.release(i, gen)
+		return err
+	}
+
+	log.Printf("chunk %d: fetching %d..%d\n", i, lo, hi)
+	runPool(ctx, numbers, noOfWorkers)
+
+	if err := stream.sync(); err != nil {
+		c.release(i, gen)
+		return err
+	}
+	if ctx.Err() != nil {
+		c.release(i, gen)
+		return nil
+	}
+	return writeFileAtomic(c.donePath(i), []byte(c.owner+"\n"))
+}
+
+func shardOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%04x", host, os.Getpid(), rand.Intn(1<<16))
+}
+
+func shardCrawl(ctx context.Context, dir string, want shardPlan, ttl time.Duration, noOfWorkers int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, shardMergedFile)); err == nil {
+		return fmt.Errorf("%s holds a crawl that was already merged (%s), start a new one in another directory", dir, strings.TrimSpace(string(data)))
+	}
+
+	if want.To == 0 {
+		numbers, err := source.IDs(ctx, want.From, 0)
+		if err != nil {
+			return err
+		}
+		if len(numbers) == 0 {
+			return fmt.Errorf("%s has no comics from %d on", source.Name(), want.From)
+		}
+		want.To = numbers[len(numbers)-1]
+	}
+	if want.To < want.From {
+		return usagef("invalid range: %d..%d", want.From, want.To)
+	}
+	plan, err := loadOrCreatePlan(dir, want)
+	if err != nil {
+		return err
+	}
+
+	c := &shardCoordinator{dir: dir, owner: shardOwner(), ttl: ttl, plan: plan}
+	if stream, err = openJSONL(filepath.Join(dir, c.owner+".jsonl")); err != nil {
+		return err
+	}
+	defer func() {
+		stream.Close()
+		stream = nil
+	}()
+	log.Printf("%s: %d..%d in %d chunks\n", c.owner, plan.From, plan.To, plan.chunks())
+
+	for ctx.Err() == nil && !c.allDone() {
+		claimed := false
+		for i := 0; i < plan.chunks() && ctx.Err() == nil; i++ {
+			gen, ok, err := c.claim(i)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			claimed = true
+			if err := c.crawlChunk(ctx, i, gen, noOfWorkers); err != nil {
+				return err
+			}
+		}
+
+		// the rest is held by other processes, wait for them to finish or for a lease to expire
+		if !claimed {
+			select {
+			case <-ctx.Done():
+			case <-time.After(min(ttl/4, 5*time.Second)):
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	// only one process merges, the others are done
+	lock, err := os.OpenFile(filepath.Join(dir, shardMergeLock), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		log.Printf("%s: every chunk is done, another process merges\n", c.owner)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(lock, c.owner)
+	lock.Close()
+	return mergeShards(dir)
+}
+
+// mergeShards merges the logs of every process in dir into the index.
+func mergeShards(dir string) error {
+	logs, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(logs)
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	for _, path := range logs {
+		logged, err := readJSONL(path)
+		if err != nil {
+			return err
+		}
+		index = mergeResults(index, logged)
+	}
+
+	if err := writeIndex(index); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, shardMergedFile), []byte(time.Now().Format(time.RFC3339)+"\n")); err != nil {
+		return err
+	}
+	log.Printf("merged %d shard logs into %s (%d comics)\n", len(logs), indexFile, len(index))
+	return nil
+}
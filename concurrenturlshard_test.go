@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const shardTestLatest = 250
+
+// newComicServer stands in for xkcd.com with comics 1..latest.
+func newComicServer(t *testing.T, latest int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info.0.json" {
+			fmt.Fprint(w, comicJSON(latest))
+			return
+		}
+		num, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/info.0.json")
+		n, err := strconv.Atoi(num)
+		if !ok || err != nil || n < 1 || n > latest {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, comicJSON(n))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestShardProcess is the crawler process started by TestShardCrawl, it is skipped when run directly.
+func TestShardProcess(t *testing.T) {
+	args := os.Getenv("XKCD_TEST_SHARD_ARGS")
+	if args == "" {
+		t.Skip("only run as a child of TestShardCrawl")
+	}
+	os.Exit(run(strings.Split(args, " ")))
+}
+
+// shardProcess starts the test binary as one process of the crawl in dir.
+func shardProcess(t *testing.T, url, dir string) *exec.Cmd {
+	args := fmt.Sprintf("shard -url %s -shards %s -index %s -chunk 20 -lease 2s -rate 0 -robots=false -cache= -progress=false -workers 4",
+		url, dir, filepath.Join(dir, "xkcd.json"))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShardProcess$")
+	cmd.Env = append(os.Environ(), "XKCD_TEST_SHARD_ARGS="+args)
+	// nothing the processes write ends up in the package directory
+	cmd.Dir = t.TempDir()
+	return cmd
+}
+
+func TestShardCrawl(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several processes")
+	}
+	srv := newComicServer(t, shardTestLatest)
+	dir := t.TempDir()
+
+	var procs []*exec.Cmd
+	for i := 0; i < 3; i++ {
+		cmd := shardProcess(t, srv.URL, dir)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		procs = append(procs, cmd)
+	}
+	for i, cmd := range procs {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("process %d: %v", i, err)
+		}
+	}
+
+	oldIndex := indexFile
+	defer func() { indexFile = oldIndex }()
+	indexFile = filepath.Join(dir, "xkcd.json")
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != shardTestLatest {
+		t.Fatalf("merged index has %d comics, want %d", len(index), shardTestLatest)
+	}
+	for i, r := range index {
+		if r.Num != i+1 {
+			t.Fatalf("index[%d] is #%d, want #%d", i, r.Num, i+1)
+		}
+	}
+
+	done, _ := filepath.Glob(filepath.Join(dir, "chunk-*.done"))
+	if want := (shardTestLatest + 19) / 20; len(done) != want {
+		t.Errorf("%d chunks done, want %d", len(done), want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, shardMergedFile)); err != nil {
+		t.Errorf("no merged marker: %v", err)
+	}
+
+	// a finished directory is not crawled again
+	err = shardProcess(t, srv.URL, dir).Run()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitError {
+		t.Errorf("rerun in a merged directory: got %v, want exit code %d", err, exitError)
+	}
+}
+
+func TestShardLeaseTakeover(t *testing.T) {
+	dir := t.TempDir()
+	plan := shardPlan{From: 1, To: 100, Chunk: 10}
+	a := &shardCoordinator{dir: dir, owner: "a", ttl: 50 * time.Millisecond, plan: plan}
+	b := &shardCoordinator{dir: dir, owner: "b", ttl: 50 * time.Millisecond, plan: plan}
+
+	gen, ok, err := a.claim(3)
+	if err != nil || !ok || gen != 1 {
+		t.Fatalf("a.claim: gen %d, ok %v, err %v", gen, ok, err)
+	}
+	if _, ok, err := b.claim(3); err != nil || ok {
+		t.Fatalf("b claimed a live lease: ok %v, err %v", ok, err)
+	}
+
+	// a crashed and stopped renewing
+	time.Sleep(60 * time.Millisecond)
+	gen, ok, err = b.claim(3)
+	if err != nil || !ok || gen != 2 {
+		t.Fatalf("b.claim after expiry: gen %d, ok %v, err %v", gen, ok, err)
+	}
+	if _, l, err := a.currentLease(3); err != nil || l.Owner != "b" {
+		t.Fatalf("current lease: %+v, %v", l, err)
+	}
+
+	if err := writeFileAtomic(b.donePath(3), []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, _ := a.claim(3); ok {
+		t.Error("a claimed a chunk that is done")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Showing one comic from the index.
+
+	go run concurrenturl*.go show 353
+	go run concurrenturl*.go show latest
+	go run concurrenturl*.go show -json random
+
+Prints the title, date, image, alt text and transcript of the comic, or with -json the record as it is stored in the index. An -index ending in .bin is read as a binary index (see concurrenturlbinary.go), which only decodes the one comic.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+func printComic(r Result) {
+	fmt.Printf("#%d %s\n", r.Num, r.Title)
+	if !r.Published.IsZero() {
+		fmt.Println(r.Published.Format(dateLayout))
+	}
+	fmt.Println(r.Img)
+	if r.Image != nil {
+		fmt.Printf("mirrored as %s (%s, %dx%d)\n", r.Image.SHA256, r.Image.MIME, r.Image.Width, r.Image.Height)
+	}
+	if r.Link != "" {
+		fmt.Println(r.Link)
+	}
+	if r.Alt != "" {
+		fmt.Printf("\n%s\n", r.Alt)
+	}
+	if r.Transcript != "" {
+		fmt.Printf("\n%s\n", r.Transcript)
+	}
+}
+
+// anyComic is what comicNumber returns for "random"
+const anyComic = -1
+
+// comicNumber parses the argument of show, latest is the highest number in the index.
+func comicNumber(arg string, latest int) (int, error) {
+	switch arg {
+	case "latest":
+		return latest, nil
+	case "random":
+		return anyComic, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, usagef("%q is not a comic number", arg)
+	}
+	return n, nil
+}
+
+func findComic(arg string) (Result, error) {
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(index) == 0 {
+		return Result{}, fmt.Errorf("%s is empty", indexFile)
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+
+	n, err := comicNumber(arg, index[len(index)-1].Num)
+	if err != nil {
+		return Result{}, err
+	}
+	if n == anyComic {
+		return index[rand.Intn(len(index))], nil
+	}
+	i := sort.Search(len(index), func(i int) bool { return index[i].Num >= n })
+	if i == len(index) || index[i].Num != n {
+		return Result{}, fmt.Errorf("#%d is not in %s", n, indexFile)
+	}
+	return index[i], nil
+}
+
+// findBinaryComic only decodes the one comic (see concurrenturlbinary.go).
+func findBinaryComic(arg string) (Result, error) {
+	b, err := openBinaryIndex(indexFile)
+	if err != nil {
+		return Result{}, err
+	}
+	defer b.Close()
+	if b.Len() == 0 {
+		return Result{}, fmt.Errorf("%s is empty", indexFile)
+	}
+
+	n, err := comicNumber(arg, b.Latest())
+	if err != nil {
+		return Result{}, err
+	}
+	if n == anyComic {
+		n = int(b.byNum[rand.Intn(b.Len())].Num)
+	}
+	return b.Get(n)
+}
+
+func showCommand(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	addIndexFlag(fs)
+	asJSON := fs.Bool("json", false, "print the comic as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("need one comic: a number, latest or random")
+	}
+
+	find := findComic
+	if isBinaryIndex(indexFile) {
+		find = findBinaryComic
+	}
+	comic, err := find(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(comic)
+	}
+	printComic(comic)
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+Result sinks.
+
+getResults hands every fetched comic to a list of sinks. The first one is always the index: the results are collected for xkcd.json, or with -jsonl appended to the log (see concurrenturljsonl.go). -sink adds more and can be given several times:
+
+	go run concurrenturl*.go -sink stdout | jq .title
+	go run concurrenturl*.go -sink json:new.json -sink webhook:https://example.com/hook
+
+	stdout          one JSON object per line; the progress and summary lines then go to stderr
+	json:path       this run's results as a JSON array, sorted by number, written at the end of the run
+	jsonl:path      this run's results appended to a JSON Lines log as they arrive
+	webhook:url     POSTs the results as JSON arrays of up to 50, at least every 5 seconds
+
+Every result goes to every sink. A sink that fails only logs its error; the others, and the crawl, go on. The webhook posts from its own goroutine, so a slow endpoint does not hold up the crawl. A failed POST is retried like a comic (see concurrenturlretry.go): 429, 5xx and network errors with backoff, honoring Retry-After. A batch that still fails is dropped and counted in the summary, and after Ctrl-C whatever is still waiting is dropped instead of holding up the exit.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// how much the webhook posts at once, how long a result may wait for its batch, and how many batches may wait to be posted
+const (
+	webhookBatch    = 50
+	webhookInterval = 5 * time.Second
+	webhookQueue    = 64
+)
+
+type Sink interface {
+	Write(r Result) error
+	Close() error
+}
+
+// sinks are the sinks from -sink, getResults writes to them after the index
+var sinks multiSink
+
+// console is where the crawl reports, stderr when -sink stdout takes stdout for the results
+var console io.Writer = os.Stdout
+
+// multiSink writes to every sink even when some of them fail.
+type multiSink []Sink
+
+func (m multiSink) Write(r Result) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resultSinks are the sinks of one pool run: the index, then the sinks from -sink.
+func resultSinks() multiSink {
+	var index Sink = indexSink{}
+	if stream != nil {
+		index = stream
+	}
+	return append(multiSink{index}, sinks...)
+}
+
+// indexSink collects the results in resultCollection, which the crawl writes to the index when it ends.
+type indexSink struct{}
+
+func (indexSink) Write(r Result) error {
+	resultCollection = append(resultCollection, r)
+	return nil
+}
+
+func (indexSink) Close() error { return nil }
+
+type stdoutSink struct {
+	enc *json.Encoder
+}
+
+func (s stdoutSink) Write(r Result) error {
+	return s.enc.Encode(r)
+}
+
+func (stdoutSink) Close() error { return nil }
+
+type jsonFileSink struct {
+	path    string
+	results []Result
+}
+
+func (s *jsonFileSink) Write(r Result) error {
+	s.results = append(s.results, r)
+	return nil
+}
+
+func (s *jsonFileSink) Close() error {
+	sort.SliceStable(s.results, func(i, j int) bool { return s.results[i].Num < s.results[j].Num })
+	data, err := json.MarshalIndent(s.results, "", "    ")
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	if s.results == nil {
+		data = []byte("[]")
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+type webhookSink struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+	queue  chan Result
+	done   chan struct{}
+
+	sent    int // only touched by the sending goroutine until done is closed
+	dropped atomic.Int64
+}
+
+func newWebhookSink(ctx context.Context, url string) *webhookSink {
+	w := &webhookSink{
+		ctx:    ctx,
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+		queue:  make(chan Result, webhookBatch*webhookQueue),
+		done:   make(chan struct{}),
+	}
+	go w.send()
+	return w
+}
+
+func (w *webhookSink) Write(r Result) error {
+	select {
+	case w.queue <- r:
+		return nil
+	default:
+		// the endpoint is too far behind, the crawl does not wait for it
+		w.dropped.Add(1)
+		return fmt.Errorf("webhook %s: queue full, dropping #%d", w.url, r.Num)
+	}
+}
+
+func (w *webhookSink) Close() error {
+	close(w.queue)
+	<-w.done
+
+	dropped := w.dropped.Load()
+	log.Printf("webhook %s: posted %d results, dropped %d\n", w.url, w.sent, dropped)
+	if dropped > 0 {
+		return fmt.Errorf("webhook %s: %d results could not be posted", w.url, dropped)
+	}
+	return nil
+}
+
+// send posts full batches as they fill up, and whatever is waiting on every tick so a stalled crawl still delivers.
+func (w *webhookSink) send() {
+	defer close(w.done)
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	var batch []Result
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := w.postWithRetry(batch, defaultRetry); err != nil {
+			log.Printf("webhook %s: dropping %d results: %v\n", w.url, len(batch), err)
+			w.dropped.Add(int64(len(batch)))
+		} else {
+			w.sent += len(batch)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case r, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= webhookBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (w *webhookSink) postWithRetry(batch []Result, p retryPolicy) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if classify(err) != classTransient || attempt >= p.MaxAttempts {
+			return fmt.Errorf("after %d attempt(s): %w", attempt, err)
+		}
+
+		delay := p.backoff(attempt, err)
+		log.Printf("webhook %s: retrying in %v (attempt %d): %v\n", w.url, delay.Round(time.Millisecond), attempt, err)
+
+		// an interrupted crawl does not wait for the endpoint to come back
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+	}
+}
+
+func (w *webhookSink) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", defaultUserAgent)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{Code: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+// openSinks opens the sinks of the -sink flags, closing the ones already opened when one fails.
+func openSinks(ctx context.Context, specs []string) (multiSink, error) {
+	var list multiSink
+	for _, spec := range specs {
+		kind, target, _ := strings.Cut(spec, ":")
+
+		var s Sink
+		switch {
+		case kind == "stdout" && target == "":
+			s = stdoutSink{json.NewEncoder(os.Stdout)}
+			console = os.Stderr
+		case kind == "json" && target != "":
+			s = &jsonFileSink{path: target}
+		case kind == "jsonl" && target != "":
+			w, err := openJSONL(target)
+			if err != nil {
+				list.Close()
+				return nil, err
+			}
+			s = w
+		case kind == "webhook" && target != "":
+			s = newWebhookSink(ctx, target)
+		default:
+			list.Close()
+			return nil, usagef("-sink %q: want stdout, json:path, jsonl:path or webhook:url", spec)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
@@ -0,0 +1,110 @@
+/*
+Comic sources.
+
+The worker pool, retries, checkpoints and exports do not care where the comics come from. Everything that is specific to one site sits behind the Source interface:
+
+	IDs       which item numbers exist in a range (a zero "to" means up to the newest item)
+	Fetch     download the raw document of one item
+	Decode    turn that document into the normalized record, Result
+
+xkcd (concurrenturlxkcd.go) is the first adapter. Another JSON-per-item API only needs its own Source and an entry in sources.
+
+Which source to use and its base URL come from a JSON config file given with -config:
+
+	{
+	    "source": "xkcd",
+	    "base_url": "http://127.0.0.1:8080"
+	}
+
+Pointing base_url at a local server (for example an httptest stand-in) runs the whole crawler without touching the real site.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+type Source interface {
+	Name() string
+	IDs(ctx context.Context, from, to int) ([]int, error)
+	Fetch(ctx context.Context, id int) ([]byte, error)
+	Decode(data []byte) (Result, error)
+}
+
+// sources knows every adapter by the name used in the config file
+var sources = map[string]func(baseURL string) Source{
+	"xkcd": newXkcdSource,
+}
+
+// source is what the crawl fetches from, main replaces it when a config file is given
+var source = newXkcdSource(Url)
+
+type Config struct {
+	Source  string `json:"source"`
+	BaseURL string `json:"base_url"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Config{Source: "xkcd"}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("json err: %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) newSource() (Source, error) {
+	newSource, ok := sources[c.Source]
+	if !ok {
+		var names []string
+		for name := range sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown source %q, available: %s", c.Source, strings.Join(names, ", "))
+	}
+	return newSource(c.BaseURL), nil
+}
+
+/*
+getBody is the plain GET that sources build on. It goes through politeDo like every other request, and turns any status other than 200 OK into a statusError so the retry policy can classify it.
+*/
+
+func getBody(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request: %w", err)
+	}
+
+	resp, err := politeDo(ctx, httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("http err: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{
+			Code:       resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("http err: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,160 @@
+/*
+Incremental sync for the xkcd index built by concurrenturl.go.
+
+A full crawl downloads every comic in its range again and replaces those entries of xkcd.json. Most of the index never changes, so the sync mode loads the existing xkcd.json, asks the source for the newest issue number (https://xkcd.com/info.0.json), and only fetches the issues that are missing from the index (including anything newer than what we already have). The new results are merged into the existing []Result and the file is written back sorted by Num.
+
+Run it together with the crawler:
+
+	go run concurrenturl*.go sync
+	go run concurrenturl*.go sync -from 2500
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// indexFile is the JSON index every command reads or writes, -index changes it
+var indexFile = "xkcd.json"
+
+/*
+loadIndex reads a previously written index. A missing file is not an error: it simply means we start with an empty index and the sync turns into a full crawl.
+*/
+
+func loadIndex(path string) ([]Result, error) {
+	if isBinaryIndex(path) {
+		index, err := readBinaryIndex(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return index, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index []Result
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("json err: %s: %v", path, err)
+	}
+	return index, nil
+}
+
+// missingNumbers lists every issue of numbers that is not in the index yet.
+func missingNumbers(index []Result, numbers []int) []int {
+	have := make(map[int]bool, len(index))
+	for _, r := range index {
+		have[r.Num] = true
+	}
+
+	var missing []int
+	for _, n := range numbers {
+		if !have[n] {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+/*
+mergeResults adds the freshly fetched results to the index. A fetched result replaces an existing one with the same Num, everything else is kept untouched. The merged index is sorted by Num so the file stays stable between runs.
+*/
+
+func mergeResults(index, fetched []Result) []Result {
+	byNum := make(map[int]int, len(index))
+	for i, r := range index {
+		byNum[r.Num] = i
+	}
+
+	for _, r := range fetched {
+		if i, ok := byNum[r.Num]; ok {
+			index[i] = r
+			continue
+		}
+		byNum[r.Num] = len(index)
+		index = append(index, r)
+	}
+
+	sort.Slice(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+	return index
+}
+
+func syncIndex(ctx context.Context, from, to, noOfWorkers int, jsonlPath string) error {
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+
+	numbers, err := source.IDs(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	missing := missingNumbers(index, numbers)
+	log.Printf("index has %d comics, %d of %d in range to fetch\n", len(index), len(missing), len(numbers))
+
+	// only the missing numbers go through the worker pool
+	if len(missing) > 0 {
+		if index, err = fetchInto(ctx, index, missing, noOfWorkers, jsonlPath); err != nil {
+			return err
+		}
+	} else if mirror == nil {
+		return nil
+	}
+
+	// comics crawled before images were mirrored get theirs now
+	mirrorMissing(ctx, index, noOfWorkers)
+
+	return writeIndex(index)
+}
+
+// fetchInto runs the worker pool over numbers and merges what it fetched into index.
+func fetchInto(ctx context.Context, index []Result, numbers []int, noOfWorkers int, jsonlPath string) ([]Result, error) {
+	runPool(ctx, numbers, noOfWorkers)
+
+	// with -jsonl the results are in the log, compacting merges them into xkcd.json
+	if stream != nil {
+		return finishStream(jsonlPath)
+	}
+	return mergeResults(index, resultCollection), nil
+}
+
+// updateIndex merges collected into the index on disk and writes it back; comics that were not fetched again are kept.
+func updateIndex(collected []Result) ([]Result, error) {
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	index = mergeResults(index, collected)
+	return index, writeIndex(index)
+}
+
+// writeIndex writes index to indexFile sorted by number, results of a crawl arrive in any order.
+func writeIndex(index []Result) error {
+	// an empty index is written as [], never as null
+	if index == nil {
+		index = []Result{}
+	}
+	sort.SliceStable(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+	if isBinaryIndex(indexFile) {
+		return writeBinaryIndex(indexFile, index)
+	}
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return fmt.Errorf("json err: %v", err)
+	}
+	return writeToFile(data)
+}
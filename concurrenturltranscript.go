@@ -0,0 +1,266 @@
+/*
+Structured transcripts.
+
+Result.Transcript is one raw string in the wiki format xkcd uses:
+
+	[[Cueball stands at a whiteboard.]]      a scene note
+	Cueball: I have a plan.                  a line of dialogue
+	Megan and Cueball: No.                   several speakers at once
+	{{Title text: The plan was bad.}}        the title text, usually at the end
+
+parseTranscript turns it into an ordered list of ScriptLines, each a scene note, a line of dialogue with its speaker, the title text or plain text (captions and anything else). The xkcd source stores it as "script" next to the raw transcript; comics from an older xkcd.json are parsed when they are queried.
+
+The transcripts command queries the whole index:
+
+	go run concurrenturl*.go transcripts -speaker Megan       comics where Megan speaks
+	go run concurrenturl*.go transcripts -count -n 20          lines per character
+	go run concurrenturl*.go transcripts -num 1000             the parsed transcript of one comic
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	lineScene    = "scene"
+	lineDialogue = "dialogue"
+	lineTitle    = "title"
+	lineText     = "text"
+
+	maxSpeakerLen = 40 // a longer prefix before ":" is a sentence, not a name
+)
+
+type ScriptLine struct {
+	Kind    string `json:"kind"`
+	Speaker string `json:"speaker,omitempty"`
+	Text    string `json:"text"`
+}
+
+func parseTranscript(raw string) []ScriptLine {
+	var lines []ScriptLine
+	rest := strings.ReplaceAll(raw, "\r\n", "\n")
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " \t\n")
+		switch {
+		case rest == "":
+
+		// scene notes and the title text may span several lines
+		case strings.HasPrefix(rest, "[["):
+			var note string
+			note, rest = cutBlock(rest[2:], "]]")
+			lines = append(lines, ScriptLine{Kind: lineScene, Text: note})
+
+		case strings.HasPrefix(rest, "{{"):
+			var block string
+			block, rest = cutBlock(rest[2:], "}}")
+			if label, text, ok := strings.Cut(block, ":"); ok && isTitleLabel(label) {
+				lines = append(lines, ScriptLine{Kind: lineTitle, Text: strings.TrimSpace(text)})
+			} else {
+				lines = append(lines, ScriptLine{Kind: lineText, Text: block})
+			}
+
+		default:
+			var line string
+			line, rest, _ = strings.Cut(rest, "\n")
+			line = strings.TrimSpace(line)
+			if speaker, text, ok := cutSpeaker(line); ok {
+				lines = append(lines, ScriptLine{Kind: lineDialogue, Speaker: speaker, Text: text})
+			} else {
+				lines = append(lines, ScriptLine{Kind: lineText, Text: line})
+			}
+		}
+	}
+	return lines
+}
+
+// cutBlock returns the text up to end and what follows it, an unterminated block runs to the end of s.
+func cutBlock(s, end string) (block, rest string) {
+	block, rest, _ = strings.Cut(s, end)
+	return strings.Join(strings.Fields(block), " "), rest
+}
+
+func isTitleLabel(label string) bool {
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "title text", "alt text", "alt-text", "alt", "title-text", "mouseover text", "mouseover":
+		return true
+	}
+	return false
+}
+
+// cutSpeaker splits "Cueball: text" into the speaker and the text, rejecting prefixes that do not look like a name.
+func cutSpeaker(line string) (speaker, text string, ok bool) {
+	speaker, text, ok = strings.Cut(line, ":")
+	if !ok {
+		return "", "", false
+	}
+	speaker, text = strings.TrimSpace(speaker), strings.TrimSpace(text)
+	if speaker == "" || len(speaker) > maxSpeakerLen || strings.HasPrefix(text, "//") {
+		return "", "", false
+	}
+	if strings.ContainsAny(speaker, "[]{}<>\"") || !unicode.IsLetter([]rune(speaker)[0]) {
+		return "", "", false
+	}
+	return speaker, text, true
+}
+
+// speakers splits a line spoken together, "Megan and Cueball", into the single names.
+func (l ScriptLine) speakers() []string {
+	if l.Kind != lineDialogue {
+		return nil
+	}
+	s := strings.NewReplacer(" and ", ",", " & ", ",", "/", ",").Replace(l.Speaker)
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// script is the parsed transcript of r, parsing it now for results that were stored without one.
+func (r *Result) script() []ScriptLine {
+	if r.Script == nil && r.Transcript != "" {
+		r.Script = parseTranscript(r.Transcript)
+	}
+	return r.Script
+}
+
+// linesBy counts the lines spoken by speaker in every comic, matching names case-insensitively.
+func linesBy(index []Result, speaker string) map[int]int {
+	counts := make(map[int]int)
+	for i := range index {
+		for _, l := range index[i].script() {
+			for _, name := range l.speakers() {
+				if strings.EqualFold(name, speaker) {
+					counts[index[i].Num]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+type speakerCount struct {
+	Name   string
+	Lines  int
+	Comics int
+}
+
+// countSpeakers counts lines and comics per character, the name is kept as it is written most often.
+func countSpeakers(index []Result) []speakerCount {
+	byKey := make(map[string]*speakerCount)
+	spellings := make(map[string]map[string]int)
+	for i := range index {
+		seen := make(map[string]bool)
+		for _, l := range index[i].script() {
+			for _, name := range l.speakers() {
+				key := strings.ToLower(name)
+				c, ok := byKey[key]
+				if !ok {
+					c = &speakerCount{}
+					byKey[key] = c
+					spellings[key] = make(map[string]int)
+				}
+				c.Lines++
+				spellings[key][name]++
+				if !seen[key] {
+					seen[key] = true
+					c.Comics++
+				}
+			}
+		}
+	}
+
+	counts := make([]speakerCount, 0, len(byKey))
+	for key, c := range byKey {
+		for name, n := range spellings[key] {
+			if best := spellings[key][c.Name]; n > best || n == best && name < c.Name {
+				c.Name = name
+			}
+		}
+		counts = append(counts, *c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Lines != counts[j].Lines {
+			return counts[i].Lines > counts[j].Lines
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+func printScript(r Result) {
+	fmt.Printf("#%d %s\n", r.Num, r.Title)
+	for _, l := range r.script() {
+		switch l.Kind {
+		case lineScene:
+			fmt.Printf("  (%s)\n", l.Text)
+		case lineDialogue:
+			fmt.Printf("  %s: %s\n", l.Speaker, l.Text)
+		case lineTitle:
+			fmt.Printf("  title text: %s\n", l.Text)
+		default:
+			fmt.Printf("  %s\n", l.Text)
+		}
+	}
+}
+
+func transcriptsCommand(args []string) error {
+	fs := flag.NewFlagSet("transcripts", flag.ExitOnError)
+	addIndexFlag(fs)
+	speaker := fs.String("speaker", "", "list the comics where this character speaks")
+	count := fs.Bool("count", false, "count the lines per character")
+	num := fs.Int("num", 0, "print the parsed transcript of this comic")
+	n := fs.Int("n", 20, "number of characters to show with -count (0 means all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Num < index[j].Num })
+
+	switch {
+	case *num != 0:
+		for _, r := range index {
+			if r.Num == *num {
+				printScript(r)
+				return nil
+			}
+		}
+		return fmt.Errorf("#%d is not in %s", *num, indexFile)
+
+	case *speaker != "":
+		counts := linesBy(index, *speaker)
+		for _, r := range index {
+			if c := counts[r.Num]; c > 0 {
+				fmt.Printf("#%d %s (%d lines)\n", r.Num, r.Title, c)
+			}
+		}
+		fmt.Printf("%s speaks in %d comics\n", *speaker, len(counts))
+
+	case *count:
+		counts := countSpeakers(index)
+		if *n > 0 {
+			counts = counts[:min(*n, len(counts))]
+		}
+		for _, c := range counts {
+			fmt.Printf("%6d lines  %5d comics  %s\n", c.Lines, c.Comics, c.Name)
+		}
+
+	default:
+		return usagef("one of -speaker, -count or -num is needed")
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+/*
+Checking the integrity of xkcd.json.
+
+An index that was interrupted, merged by hand or written by an older version can look fine and still be incomplete. verify loads xkcd.json and checks:
+
+	gap          a number between -from and the newest comic that is not in the index; numbers in knownMissing (see concurrenturlxkcd.go) are listed separately, they were never published
+	duplicate    the same number more than once
+	empty        an empty num, title, safe_title, img, year, month or day
+	date         year/month/day that do not form a real date
+	insecure     an image URL that is not HTTPS
+	order        an entry whose number is lower than the one before it
+	image        a mirrored image that is missing or corrupted (see concurrenturlimages.go)
+
+Ordering problems are warnings, as every writer sorts the index anyway; everything else is an error and makes verify exit with a non-zero status. -json prints the report as JSON for scripts, -repair refetches every number with an error in the index and merges it back, which also removes duplicates and restores the order.
+
+	go run concurrenturl*.go verify
+	go run concurrenturl*.go verify -json > report.json
+	go run concurrenturl*.go verify -repair
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+type indexProblem struct {
+	Num      int    `json:"num"`
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type verifyReport struct {
+	Comics       int            `json:"comics"`
+	Last         int            `json:"last"`
+	KnownMissing []int          `json:"known_missing"`
+	Errors       int            `json:"errors"`
+	Warnings     int            `json:"warnings"`
+	Problems     []indexProblem `json:"problems"`
+	Images       []imageProblem `json:"images"`
+	Unmirrored   int            `json:"unmirrored"`
+}
+
+// checkIndex runs every check on the index in the order it is stored.
+func checkIndex(index []Result, from int) verifyReport {
+	report := verifyReport{Comics: len(index), KnownMissing: []int{}, Problems: []indexProblem{}}
+	add := func(num int, check, severity, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, indexProblem{num, check, severity, fmt.Sprintf(format, args...)})
+	}
+
+	seen := make(map[int]int, len(index))
+	prev := 0
+	for _, r := range index {
+		seen[r.Num]++
+		if seen[r.Num] == 2 {
+			add(r.Num, "duplicate", severityError, "#%d appears more than once", r.Num)
+		}
+		if r.Num < prev {
+			add(r.Num, "order", severityWarning, "#%d comes after #%d", r.Num, prev)
+		}
+		prev = r.Num
+		report.Last = max(report.Last, r.Num)
+
+		var empty []string
+		for _, f := range []struct{ name, value string }{
+			{"title", r.Title}, {"safe_title", r.SafeTitle}, {"img", r.Img},
+			{"year", r.Year}, {"month", r.Month}, {"day", r.Day},
+		} {
+			if strings.TrimSpace(f.value) == "" {
+				empty = append(empty, f.name)
+			}
+		}
+		if r.Num <= 0 {
+			empty = append([]string{"num"}, empty...)
+		}
+		if len(empty) > 0 {
+			add(r.Num, "empty", severityError, "#%d has no %s", r.Num, strings.Join(empty, ", "))
+		}
+
+		if r.Year != "" && r.Month != "" && r.Day != "" {
+			if _, err := parseDate(r.Year, r.Month, r.Day); err != nil {
+				add(r.Num, "date", severityError, "#%d: %v", r.Num, err)
+			}
+		}
+
+		if r.Img != "" && !strings.HasPrefix(r.Img, "https://") {
+			add(r.Num, "insecure", severityError, "#%d: image URL %s is not HTTPS", r.Num, r.Img)
+		}
+	}
+
+	for n := from; n <= report.Last; n++ {
+		switch {
+		case seen[n] > 0:
+		case knownMissing[n]:
+			report.KnownMissing = append(report.KnownMissing, n)
+		default:
+			add(n, "gap", severityError, "#%d is missing", n)
+		}
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool { return report.Problems[i].Num < report.Problems[j].Num })
+	report.count()
+	return report
+}
+
+func (r *verifyReport) count() {
+	r.Errors, r.Warnings = len(r.Images), 0
+	for _, p := range r.Problems {
+		if p.Severity == severityError {
+			r.Errors++
+		} else {
+			r.Warnings++
+		}
+	}
+}
+
+// repairNumbers are the numbers worth fetching again: every one with an error in the index.
+func (r *verifyReport) repairNumbers() []int {
+	var numbers []int
+	seen := make(map[int]bool)
+	for _, p := range r.Problems {
+		if p.Severity == severityError && p.Num > 0 && !seen[p.Num] {
+			seen[p.Num] = true
+			numbers = append(numbers, p.Num)
+		}
+	}
+	return numbers
+}
+
+// dedupe keeps the last entry for every number, like mergeResults does for fetched results.
+func dedupe(index []Result) []Result {
+	last := make(map[int]int, len(index))
+	for i, r := range index {
+		last[r.Num] = i
+	}
+	out := index[:0]
+	for i, r := range index {
+		if last[r.Num] == i {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (r *verifyReport) print() {
+	for _, p := range r.Problems {
+		fmt.Printf("%s: %s\n", p.Severity, p.Message)
+	}
+	for _, p := range r.Images {
+		fmt.Printf("error: #%d: image %s\n", p.Num, p.Problem)
+	}
+	if len(r.KnownMissing) > 0 {
+		fmt.Printf("known missing: %v\n", r.KnownMissing)
+	}
+	fmt.Printf("%d comics up to #%d, %d errors, %d warnings, %d without a mirrored image\n", r.Comics, r.Last, r.Errors, r.Warnings, r.Unmirrored)
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	addIndexFlag(fs)
+	dir := fs.String("images", "images", "directory of the image store")
+	from := fs.Int("from", 1, "first comic number the index should contain")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	repair := fs.Bool("repair", false, "refetch the comics with errors and merge them into xkcd.json")
+	workers := fs.Int("workers", 10, "number of workers for -repair")
+	configPath := fs.String("config", "", "JSON config file choosing the source for -repair")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return usagef("-workers must be at least 1, got %d", *workers)
+	}
+
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if source, err = cfg.newSource(); err != nil {
+			return err
+		}
+	}
+
+	index, err := loadIndex(indexFile)
+	if err != nil {
+		return err
+	}
+
+	report := checkIndex(index, *from)
+
+	// the pool reports what it fetched on the console, the report must be the only thing on stdout
+	if *asJSON {
+		console = os.Stderr
+	}
+
+	if numbers := report.repairNumbers(); *repair && len(numbers) > 0 {
+		log.Printf("repairing %d comics\n", len(numbers))
+
+		ctx, stop := crawlContext(0)
+		defer stop()
+		concurrency = newAdaptiveLimit(*workers, *workers)
+
+		if index, err = fetchInto(ctx, dedupe(index), numbers, *workers, ""); err != nil {
+			return err
+		}
+		if err := writeIndex(index); err != nil {
+			return err
+		}
+		report = checkIndex(index, *from)
+	}
+
+	report.Images, report.Unmirrored = verifyImages(*dir, index)
+	if report.Images == nil {
+		report.Images = []imageProblem{}
+	}
+	report.count()
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.print()
+	}
+
+	if report.Errors > 0 {
+		return fmt.Errorf("%d errors in %s", report.Errors, indexFile)
+	}
+	return nil
+}